@@ -0,0 +1,153 @@
+// Package bencode 实现了BT协议(BEP 3)及其衍生协议(KRPC、扩展协议)共用的bencode编解码
+package bencode
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+var errUnexpectedEOF = errors.New("bencode: unexpected end of data")
+var errNonStringKey = errors.New("bencode: dict key is not a string")
+var errNegativeLength = errors.New("bencode: negative string length")
+
+// Marshal 将Go值编码为bencode字节流，支持string、[]byte、int64、int、
+// []interface{}以及map[string]interface{}（key按字典序排列，符合BEP 3要求）
+func Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := marshal(&buf, v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func marshal(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case string:
+		fmt.Fprintf(buf, "%d:%s", len(t), t)
+	case []byte:
+		fmt.Fprintf(buf, "%d:", len(t))
+		buf.Write(t)
+	case int:
+		fmt.Fprintf(buf, "i%de", t)
+	case int64:
+		fmt.Fprintf(buf, "i%de", t)
+	case uint16:
+		fmt.Fprintf(buf, "i%de", t)
+	case []interface{}:
+		buf.WriteByte('l')
+		for _, item := range t {
+			if err := marshal(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	case map[string]interface{}:
+		buf.WriteByte('d')
+		keys := make([]string, 0, len(t))
+		for k := range t {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fmt.Fprintf(buf, "%d:%s", len(k), k)
+			if err := marshal(buf, t[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('e')
+	default:
+		return fmt.Errorf("bencode: unsupported type %T", v)
+	}
+	return nil
+}
+
+// Unmarshal 将bencode字节流解码为Go值：dict->map[string]interface{},
+// list->[]interface{}, string->string, integer->int64
+func Unmarshal(data []byte) (interface{}, error) {
+	v, _, err := decode(data)
+	return v, err
+}
+
+// UnmarshalPrefix 解码data开头的一个bencode值，并返回其后未消费的剩余字节。
+// 用于ut_metadata这类"一个bencode字典后面紧跟原始二进制数据"的消息格式
+func UnmarshalPrefix(data []byte) (interface{}, []byte, error) {
+	return decode(data)
+}
+
+func decode(data []byte) (interface{}, []byte, error) {
+	if len(data) == 0 {
+		return nil, nil, errUnexpectedEOF
+	}
+	switch {
+	case data[0] == 'd':
+		m := make(map[string]interface{})
+		rest := data[1:]
+		for len(rest) > 0 && rest[0] != 'e' {
+			var key interface{}
+			var err error
+			key, rest, err = decode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			keyStr, ok := key.(string)
+			if !ok {
+				return nil, nil, errNonStringKey
+			}
+			var val interface{}
+			val, rest, err = decode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			m[keyStr] = val
+		}
+		if len(rest) == 0 {
+			return nil, nil, errUnexpectedEOF
+		}
+		return m, rest[1:], nil
+	case data[0] == 'l':
+		var list []interface{}
+		rest := data[1:]
+		for len(rest) > 0 && rest[0] != 'e' {
+			var item interface{}
+			var err error
+			item, rest, err = decode(rest)
+			if err != nil {
+				return nil, nil, err
+			}
+			list = append(list, item)
+		}
+		if len(rest) == 0 {
+			return nil, nil, errUnexpectedEOF
+		}
+		return list, rest[1:], nil
+	case data[0] == 'i':
+		end := bytes.IndexByte(data, 'e')
+		if end < 0 {
+			return nil, nil, errUnexpectedEOF
+		}
+		n, err := strconv.ParseInt(string(data[1:end]), 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		return n, data[end+1:], nil
+	default:
+		colon := bytes.IndexByte(data, ':')
+		if colon < 0 {
+			return nil, nil, errUnexpectedEOF
+		}
+		length, err := strconv.Atoi(string(data[:colon]))
+		if err != nil {
+			return nil, nil, err
+		}
+		if length < 0 {
+			return nil, nil, errNegativeLength
+		}
+		if colon+1+length > len(data) {
+			return nil, nil, errUnexpectedEOF
+		}
+		return string(data[colon+1 : colon+1+length]), data[colon+1+length:], nil
+	}
+}
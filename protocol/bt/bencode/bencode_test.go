@@ -0,0 +1,52 @@
+package bencode
+
+import "testing"
+
+func TestUnmarshalRoundTrip(t *testing.T) {
+	in := map[string]interface{}{
+		"name":   "test",
+		"length": int64(123),
+		"list":   []interface{}{"a", int64(1)},
+	}
+	data, err := Marshal(in)
+	if err != nil {
+		t.Fatalf("marshal error: %v", err)
+	}
+	v, err := Unmarshal(data)
+	if err != nil {
+		t.Fatalf("unmarshal error: %v", err)
+	}
+	m, ok := v.(map[string]interface{})
+	if !ok {
+		t.Fatalf("expected map, got %T", v)
+	}
+	if m["name"] != "test" || m["length"] != int64(123) {
+		t.Fatalf("unexpected round-trip result: %#v", m)
+	}
+}
+
+// 恶意/损坏的输入不应让decode panic，只应该返回error，因为它直接暴露在DHT这种
+// 未认证的UDP数据路径上
+func TestUnmarshalMalformedInput(t *testing.T) {
+	cases := []string{
+		"di5e3:fooe", // dict key不是字符串
+		"-5:abcde",   // 负数长度的字符串
+		"d3:fooe",    // key后面缺value
+		"l",          // 没有结尾的list
+		"i",          // 没有结尾的integer
+		"5:ab",       // 字符串长度超过剩余数据
+		"",           // 空输入
+	}
+	for _, c := range cases {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("Unmarshal(%q) panicked: %v", c, r)
+				}
+			}()
+			if _, err := Unmarshal([]byte(c)); err == nil {
+				t.Errorf("Unmarshal(%q) expected error, got nil", c)
+			}
+		}()
+	}
+}
@@ -0,0 +1,364 @@
+// Package dht 实现BEP 5描述的基于Kademlia的分布式哈希表，
+// 用于在没有或者除了tracker之外发现持有某个info_hash的peer
+package dht
+
+import (
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// alpha 是Kademlia迭代查找时并发请求的节点数
+const alpha = 3
+
+// queryTimeout 单次KRPC查询的超时时间
+const queryTimeout = 5 * time.Second
+
+// BootstrapNodes 是众所周知的公共bootstrap节点，用于首次启动时发现路由表
+var BootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// DHT 是一个本地DHT节点，维护路由表并支持get_peers迭代查找
+type DHT struct {
+	selfID       ID
+	conn         *net.UDPConn
+	routingTable *RoutingTable
+	statePath    string
+
+	txMu   sync.Mutex
+	txSeq  uint32
+	txChan map[string]chan *message
+
+	closeCh chan struct{}
+}
+
+// New 创建一个DHT实例，statePath为空时使用默认的~/.gopeed/dht.dat
+func New(statePath string) *DHT {
+	if statePath == "" {
+		if home, err := os.UserHomeDir(); err == nil {
+			statePath = filepath.Join(home, ".gopeed", "dht.dat")
+		}
+	}
+	d := &DHT{
+		selfID:    RandomID(),
+		statePath: statePath,
+		txChan:    make(map[string]chan *message),
+		closeCh:   make(chan struct{}),
+	}
+	d.routingTable = NewRoutingTable(d.selfID)
+	return d
+}
+
+// Run 启动UDP监听并引导路由表，随后持续处理收到的KRPC消息
+func (d *DHT) Run() error {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{Port: 0})
+	if err != nil {
+		return err
+	}
+	d.conn = conn
+	d.loadState()
+	go d.readLoop()
+	go d.maintain()
+	d.bootstrap()
+	return nil
+}
+
+func (d *DHT) Close() error {
+	close(d.closeCh)
+	d.saveState()
+	if d.conn != nil {
+		return d.conn.Close()
+	}
+	return nil
+}
+
+// bootstrap 向公共bootstrap节点以及磁盘上恢复的节点发起find_node，填充路由表
+func (d *DHT) bootstrap() {
+	for _, addr := range append(append([]string{}, BootstrapNodes...), d.loadedNodeAddrs()...) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			continue
+		}
+		go func(addr *net.UDPAddr) {
+			if _, err := d.findNode(addr, d.selfID); err != nil {
+				log.Debugf("dht: bootstrap %s failed: %v", addr, err)
+			}
+		}(udpAddr)
+	}
+}
+
+func (d *DHT) loadedNodeAddrs() []string {
+	var addrs []string
+	for _, n := range d.routingTable.All() {
+		addrs = append(addrs, n.Addr().String())
+	}
+	return addrs
+}
+
+func (d *DHT) maintain() {
+	ticker := time.NewTicker(5 * time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			d.routingTable.EvictStale()
+			d.saveState()
+		case <-d.closeCh:
+			return
+		}
+	}
+}
+
+func (d *DHT) nextTxID() string {
+	seq := atomic.AddUint32(&d.txSeq, 1)
+	return strconv.FormatUint(uint64(seq), 36)
+}
+
+func (d *DHT) readLoop() {
+	buf := make([]byte, 8192)
+	for {
+		n, addr, err := d.conn.ReadFromUDP(buf)
+		if err != nil {
+			select {
+			case <-d.closeCh:
+				return
+			default:
+				continue
+			}
+		}
+		msg, err := decodeMessage(buf[:n])
+		if err != nil {
+			continue
+		}
+		d.handleMessage(msg, addr)
+	}
+}
+
+func (d *DHT) handleMessage(msg *message, addr *net.UDPAddr) {
+	switch msg.Y {
+	case typeQuery:
+		d.handleQuery(msg, addr)
+	case typeResponse, typeError:
+		d.txMu.Lock()
+		ch, ok := d.txChan[msg.T]
+		d.txMu.Unlock()
+		if ok {
+			ch <- msg
+		}
+	}
+}
+
+// handleQuery 响应远端发起的ping/find_node/get_peers查询（本实现不提供announce_peer的被动存储）
+func (d *DHT) handleQuery(msg *message, addr *net.UDPAddr) {
+	switch msg.Q {
+	case queryPing:
+		d.reply(addr, newResponse(msg.T, map[string]interface{}{"id": string(d.selfID[:])}))
+	case queryFindNode, queryGetPeers:
+		var target ID
+		if t, ok := msg.A["target"].(string); ok {
+			copy(target[:], t)
+		} else if t, ok := msg.A["info_hash"].(string); ok {
+			copy(target[:], t)
+		}
+		closest := d.routingTable.Closest(target, 8)
+		nodesBuf := make([]byte, 0, len(closest)*26)
+		for _, n := range closest {
+			nodesBuf = append(nodesBuf, compactNode(n)...)
+		}
+		d.reply(addr, newResponse(msg.T, map[string]interface{}{
+			"id":    string(d.selfID[:]),
+			"nodes": string(nodesBuf),
+		}))
+	}
+	if id, ok := msg.A["id"].(string); ok && len(id) == 20 {
+		var nodeID ID
+		copy(nodeID[:], id)
+		d.routingTable.Insert(&Node{ID: nodeID, IP: addr.IP, Port: uint16(addr.Port), LastSeen: time.Now()})
+	}
+}
+
+func (d *DHT) reply(addr *net.UDPAddr, msg *message) {
+	buf, err := msg.Encode()
+	if err != nil {
+		return
+	}
+	d.conn.WriteToUDP(buf, addr)
+}
+
+// query 发送一个KRPC查询并等待对应事务号的响应
+func (d *DHT) query(addr *net.UDPAddr, q string, a map[string]interface{}) (*message, error) {
+	tid := d.nextTxID()
+	ch := make(chan *message, 1)
+	d.txMu.Lock()
+	d.txChan[tid] = ch
+	d.txMu.Unlock()
+	defer func() {
+		d.txMu.Lock()
+		delete(d.txChan, tid)
+		d.txMu.Unlock()
+	}()
+
+	a["id"] = string(d.selfID[:])
+	buf, err := newQuery(tid, q, a).Encode()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := d.conn.WriteToUDP(buf, addr); err != nil {
+		return nil, err
+	}
+	select {
+	case resp := <-ch:
+		return resp, nil
+	case <-time.After(queryTimeout):
+		return nil, errTimeout
+	}
+}
+
+func (d *DHT) ping(addr *net.UDPAddr) (*message, error) {
+	return d.query(addr, queryPing, map[string]interface{}{})
+}
+
+func (d *DHT) findNode(addr *net.UDPAddr, target ID) (*message, error) {
+	resp, err := d.query(addr, queryFindNode, map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	d.insertFromResponse(resp)
+	return resp, nil
+}
+
+func (d *DHT) getPeers(addr *net.UDPAddr, infoHash ID) (*message, error) {
+	resp, err := d.query(addr, queryGetPeers, map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+	d.insertFromResponse(resp)
+	return resp, nil
+}
+
+// AnnouncePeer 告诉一个节点本地正在做种/下载某个info_hash，implied_port=0让对方使用port参数给出的端口
+func (d *DHT) AnnouncePeer(addr *net.UDPAddr, infoHash ID, token string, port uint16) error {
+	_, err := d.query(addr, queryAnnouncePeer, map[string]interface{}{
+		"info_hash":    string(infoHash[:]),
+		"port":         int64(port),
+		"token":        token,
+		"implied_port": int64(0),
+	})
+	return err
+}
+
+// insertFromResponse 把响应nodes字段里的联系人加入路由表；应答者自身的地址不在resp里，不在这里插入
+func (d *DHT) insertFromResponse(resp *message) {
+	if resp.R == nil {
+		return
+	}
+	if nodesStr, ok := resp.R["nodes"].(string); ok {
+		for _, n := range decodeCompactNodes(nodesStr) {
+			n.LastSeen = time.Now()
+			d.routingTable.Insert(n)
+		}
+	}
+}
+
+// GetPeers 对info_hash执行alpha=3的迭代查找：每轮向最接近的未查询节点并发发起get_peers，
+// 收到values就是命中的peer列表，收到nodes就把更接近目标的节点加入候选集合继续查找
+func (d *DHT) GetPeers(infoHash [20]byte) ([]*net.UDPAddr, error) {
+	target := ID(infoHash)
+	queried := make(map[string]bool)
+	candidates := d.routingTable.Closest(target, alpha*4)
+	var peers []*net.UDPAddr
+
+	for round := 0; round < 8 && len(candidates) > 0; round++ {
+		// 每轮把这一轮新折进来的节点也纳入排序，保证下一批总是从当前已知最接近target
+		// 的未查询节点里挑，而不是退化成按发现顺序的广度优先
+		sortByDistance(candidates, target)
+		batch := candidates
+		if len(batch) > alpha {
+			batch = batch[:alpha]
+		}
+		candidates = candidates[len(batch):]
+
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		for _, n := range batch {
+			key := n.Addr().String()
+			if queried[key] {
+				continue
+			}
+			queried[key] = true
+			wg.Add(1)
+			go func(n *Node) {
+				defer wg.Done()
+				resp, err := d.getPeers(n.Addr(), target)
+				if err != nil || resp.R == nil {
+					return
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				if values, ok := resp.R["values"].([]interface{}); ok {
+					peers = append(peers, decodeCompactPeers(values)...)
+				}
+				if nodesStr, ok := resp.R["nodes"].(string); ok {
+					for _, closer := range decodeCompactNodes(nodesStr) {
+						closer.LastSeen = time.Now()
+						d.routingTable.Insert(closer)
+						candidates = append(candidates, closer)
+					}
+				}
+			}(n)
+		}
+		wg.Wait()
+		if len(peers) > 0 {
+			break
+		}
+	}
+	return peers, nil
+}
+
+// loadState 从磁盘恢复上次保存的良好节点列表
+func (d *DHT) loadState() {
+	data, err := os.ReadFile(d.statePath)
+	if err != nil {
+		return
+	}
+	for i := 0; i+26 <= len(data); i += 26 {
+		var id ID
+		copy(id[:], data[i:i+20])
+		ip := net.IP(append([]byte{}, data[i+20:i+24]...))
+		port := uint16(data[i+24])<<8 | uint16(data[i+25])
+		d.routingTable.Insert(&Node{ID: id, IP: ip, Port: port, LastSeen: time.Now()})
+	}
+	log.Debugf("dht: loaded state from %s", d.statePath)
+}
+
+// saveState 把路由表中的节点持久化，供下次启动时直接引导
+func (d *DHT) saveState() {
+	if d.statePath == "" {
+		return
+	}
+	if err := os.MkdirAll(filepath.Dir(d.statePath), 0755); err != nil {
+		return
+	}
+	nodes := d.routingTable.All()
+	buf := make([]byte, 0, len(nodes)*26)
+	for _, n := range nodes {
+		buf = append(buf, compactNode(n)...)
+	}
+	if err := os.WriteFile(d.statePath, buf, 0644); err != nil {
+		log.Debugf("dht: save state failed: %v", err)
+	}
+}
+
+func (d *DHT) String() string {
+	return "dht:" + hex.EncodeToString(d.selfID[:])
+}
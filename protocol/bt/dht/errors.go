@@ -0,0 +1,5 @@
+package dht
+
+import "errors"
+
+var errTimeout = errors.New("dht: query timed out")
@@ -0,0 +1,128 @@
+package dht
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+)
+
+// KRPC消息的y字段取值
+const (
+	typeQuery    = "q"
+	typeResponse = "r"
+	typeError    = "e"
+)
+
+// 支持的查询方法，见BEP 5
+const (
+	queryPing         = "ping"
+	queryFindNode     = "find_node"
+	queryGetPeers     = "get_peers"
+	queryAnnouncePeer = "announce_peer"
+)
+
+// message 是KRPC协议的通用消息结构，字段名与协议保持一致便于编解码
+type message struct {
+	T string                 // transaction id
+	Y string                 // message type: q/r/e
+	Q string                 // query method name
+	A map[string]interface{} // query arguments
+	R map[string]interface{} // response values
+	E []interface{}          // [errcode, errmsg]
+}
+
+func (m *message) Encode() ([]byte, error) {
+	d := map[string]interface{}{
+		"t": m.T,
+		"y": m.Y,
+	}
+	switch m.Y {
+	case typeQuery:
+		d["q"] = m.Q
+		d["a"] = m.A
+	case typeResponse:
+		d["r"] = m.R
+	case typeError:
+		d["e"] = m.E
+	}
+	return bencode.Marshal(d)
+}
+
+func decodeMessage(data []byte) (*message, error) {
+	v, err := bencode.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("dht: malformed krpc message")
+	}
+	m := &message{}
+	if t, ok := d["t"].(string); ok {
+		m.T = t
+	}
+	if y, ok := d["y"].(string); ok {
+		m.Y = y
+	}
+	if q, ok := d["q"].(string); ok {
+		m.Q = q
+	}
+	if a, ok := d["a"].(map[string]interface{}); ok {
+		m.A = a
+	}
+	if r, ok := d["r"].(map[string]interface{}); ok {
+		m.R = r
+	}
+	if e, ok := d["e"].([]interface{}); ok {
+		m.E = e
+	}
+	return m, nil
+}
+
+func newQuery(t, q string, a map[string]interface{}) *message {
+	return &message{T: t, Y: typeQuery, Q: q, A: a}
+}
+
+func newResponse(t string, r map[string]interface{}) *message {
+	return &message{T: t, Y: typeResponse, R: r}
+}
+
+// compactNode 按BEP 5编码为 20字节ID + 4字节IPv4 + 2字节端口
+func compactNode(n *Node) []byte {
+	buf := make([]byte, 26)
+	copy(buf[:20], n.ID[:])
+	copy(buf[20:24], n.IP.To4())
+	binary.BigEndian.PutUint16(buf[24:26], n.Port)
+	return buf
+}
+
+func decodeCompactNodes(s string) []*Node {
+	buf := []byte(s)
+	var nodes []*Node
+	for i := 0; i+26 <= len(buf); i += 26 {
+		var id ID
+		copy(id[:], buf[i:i+20])
+		ip := net.IP(buf[i+20 : i+24])
+		port := binary.BigEndian.Uint16(buf[i+24 : i+26])
+		nodes = append(nodes, &Node{ID: id, IP: ip, Port: port})
+	}
+	return nodes
+}
+
+// decodeCompactPeers 按BEP 5的compact格式（4字节IPv4 + 2字节端口）解码values列表
+func decodeCompactPeers(values []interface{}) []*net.UDPAddr {
+	var peers []*net.UDPAddr
+	for _, v := range values {
+		s, ok := v.(string)
+		if !ok || len(s) != 6 {
+			continue
+		}
+		buf := []byte(s)
+		ip := net.IP(buf[:4])
+		port := binary.BigEndian.Uint16(buf[4:6])
+		peers = append(peers, &net.UDPAddr{IP: ip, Port: int(port)})
+	}
+	return peers
+}
@@ -0,0 +1,74 @@
+package dht
+
+import (
+	"crypto/rand"
+	"net"
+	"sort"
+	"time"
+)
+
+// ID 是DHT网络中节点或info_hash的160位(20字节)标识，与SHA-1哈希空间一致
+type ID [20]byte
+
+// RandomID 生成一个随机的节点ID，用作本地DHT实例的身份
+func RandomID() ID {
+	var id ID
+	rand.Read(id[:])
+	return id
+}
+
+// Distance 按KRPC/Kademlia规范以异或计算两个ID之间的"距离"
+func (id ID) Distance(other ID) ID {
+	var d ID
+	for i := range id {
+		d[i] = id[i] ^ other[i]
+	}
+	return d
+}
+
+// leadingZeros 返回距离的前导0比特数，用来确定该距离落在路由表的哪个桶里
+func (id ID) leadingZeros() int {
+	for i, b := range id {
+		if b == 0 {
+			continue
+		}
+		for bit := 0; bit < 8; bit++ {
+			if b&(0x80>>uint(bit)) != 0 {
+				return i*8 + bit
+			}
+		}
+	}
+	return len(id) * 8
+}
+
+// Node 是路由表中的一个联系人
+type Node struct {
+	ID       ID
+	IP       net.IP
+	Port     uint16
+	LastSeen time.Time
+}
+
+func (n *Node) Addr() *net.UDPAddr {
+	return &net.UDPAddr{IP: n.IP, Port: int(n.Port)}
+}
+
+// sortByDistance 按与target的异或距离从近到远原地排序nodes，RoutingTable.Closest和
+// 迭代查找GetPeers都靠它保证"总是优先联系最接近目标的节点"
+func sortByDistance(nodes []*Node, target ID) {
+	sort.Slice(nodes, func(i, j int) bool {
+		di := target.Distance(nodes[i].ID)
+		dj := target.Distance(nodes[j].ID)
+		for x := range di {
+			if di[x] != dj[x] {
+				return di[x] < dj[x]
+			}
+		}
+		return false
+	})
+}
+
+// Stale 判断该节点是否因超过timeout未通信而应被淘汰，默认15分钟
+func (n *Node) Stale(timeout time.Duration) bool {
+	return time.Since(n.LastSeen) > timeout
+}
@@ -0,0 +1,111 @@
+package dht
+
+import (
+	"sync"
+	"time"
+)
+
+// bucketSize 每个k-bucket最多保留的节点数，取自BEP 5推荐值k=8
+const bucketSize = 8
+
+// numBuckets ID长度为160位，因此路由表共有160个桶
+const numBuckets = 160
+
+// staleTimeout 超过该时长未响应的节点视为失效，从路由表中淘汰
+const staleTimeout = 15 * time.Minute
+
+type bucket struct {
+	nodes []*Node
+}
+
+// RoutingTable 是按异或距离分桶的Kademlia路由表
+type RoutingTable struct {
+	mu      sync.Mutex
+	selfID  ID
+	buckets [numBuckets]*bucket
+}
+
+func NewRoutingTable(selfID ID) *RoutingTable {
+	rt := &RoutingTable{selfID: selfID}
+	for i := range rt.buckets {
+		rt.buckets[i] = &bucket{}
+	}
+	return rt
+}
+
+func (rt *RoutingTable) bucketIndex(id ID) int {
+	idx := rt.selfID.Distance(id).leadingZeros()
+	if idx >= numBuckets {
+		idx = numBuckets - 1
+	}
+	return idx
+}
+
+// Insert 将节点加入对应的桶，桶满时用新节点替换一个失效节点，没有失效节点则丢弃这个新节点
+func (rt *RoutingTable) Insert(n *Node) {
+	if n.ID == rt.selfID {
+		return
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	b := rt.buckets[rt.bucketIndex(n.ID)]
+	for i, existing := range b.nodes {
+		if existing.ID == n.ID {
+			b.nodes[i] = n
+			return
+		}
+	}
+	if len(b.nodes) < bucketSize {
+		b.nodes = append(b.nodes, n)
+		return
+	}
+	for i, existing := range b.nodes {
+		if existing.Stale(staleTimeout) {
+			b.nodes[i] = n
+			return
+		}
+	}
+	// 桶已满且没有失效节点可替换，丢弃这个新节点
+}
+
+// EvictStale 移除所有超过staleTimeout未通信的节点
+func (rt *RoutingTable) EvictStale() {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	for _, b := range rt.buckets {
+		alive := b.nodes[:0]
+		for _, n := range b.nodes {
+			if !n.Stale(staleTimeout) {
+				alive = append(alive, n)
+			}
+		}
+		b.nodes = alive
+	}
+}
+
+// Closest 返回路由表中按异或距离与target最接近的k个节点
+func (rt *RoutingTable) Closest(target ID, k int) []*Node {
+	rt.mu.Lock()
+	var all []*Node
+	for _, b := range rt.buckets {
+		all = append(all, b.nodes...)
+	}
+	rt.mu.Unlock()
+
+	sortByDistance(all, target)
+	if len(all) > k {
+		all = all[:k]
+	}
+	return all
+}
+
+// All 返回路由表中所有节点，用于持久化
+func (rt *RoutingTable) All() []*Node {
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	var all []*Node
+	for _, b := range rt.buckets {
+		all = append(all, b.nodes...)
+	}
+	return all
+}
@@ -0,0 +1,61 @@
+package dht
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestRoutingTableClosestOrdersByDistance(t *testing.T) {
+	var self ID
+	rt := NewRoutingTable(self)
+
+	var near, mid, far ID
+	near[19] = 0x01
+	mid[19] = 0x02
+	far[0] = 0x80
+
+	rt.Insert(&Node{ID: far, IP: net.ParseIP("1.1.1.1"), Port: 1, LastSeen: time.Now()})
+	rt.Insert(&Node{ID: mid, IP: net.ParseIP("1.1.1.2"), Port: 2, LastSeen: time.Now()})
+	rt.Insert(&Node{ID: near, IP: net.ParseIP("1.1.1.3"), Port: 3, LastSeen: time.Now()})
+
+	closest := rt.Closest(self, 2)
+	if len(closest) != 2 {
+		t.Fatalf("expected 2 nodes, got %d", len(closest))
+	}
+	if closest[0].ID != near || closest[1].ID != mid {
+		t.Fatalf("expected [near, mid] order, got %v, %v", closest[0].ID, closest[1].ID)
+	}
+}
+
+func TestRoutingTableEvictStale(t *testing.T) {
+	var self ID
+	rt := NewRoutingTable(self)
+
+	var id ID
+	id[19] = 0x01
+	rt.Insert(&Node{ID: id, IP: net.ParseIP("1.1.1.1"), Port: 1, LastSeen: time.Now().Add(-staleTimeout * 2)})
+	if len(rt.All()) != 1 {
+		t.Fatalf("expected node to be inserted")
+	}
+	rt.EvictStale()
+	if len(rt.All()) != 0 {
+		t.Fatalf("expected stale node to be evicted")
+	}
+}
+
+func TestSortByDistance(t *testing.T) {
+	var target ID
+	var near, far ID
+	near[19] = 0x01
+	far[0] = 0x80
+
+	nodes := []*Node{
+		{ID: far, IP: net.ParseIP("1.1.1.1"), Port: 1},
+		{ID: near, IP: net.ParseIP("1.1.1.2"), Port: 2},
+	}
+	sortByDistance(nodes, target)
+	if nodes[0].ID != near || nodes[1].ID != far {
+		t.Fatalf("expected nodes sorted nearest-first, got %v, %v", nodes[0].ID, nodes[1].ID)
+	}
+}
@@ -0,0 +1,146 @@
+package metainfo
+
+import (
+	"crypto/sha1"
+	"errors"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+)
+
+// FileDetail 描述种子中单个文件在整个下载数据流中的偏移范围
+type FileDetail struct {
+	Path  []string
+	Begin int64
+	End   int64
+}
+
+// Info 对应种子文件的info字典
+type Info struct {
+	Name        string
+	PieceLength int64
+	Pieces      [][20]byte
+	Length      int64
+	Files       []*file
+
+	raw []byte
+}
+
+type file struct {
+	Length int64
+	Path   []string
+}
+
+// MetaInfo 对应一个完整的.torrent文件，或者一个还没有拿到info字典的magnet链接
+type MetaInfo struct {
+	Announce     string
+	AnnounceList [][]string
+	Info         *Info
+
+	// magnetInfoHash 在只解析出magnet链接、Info字典尚未就绪时记录info_hash，
+	// 供GetInfoHash在这段时间内兜底返回；来自.torrent文件的MetaInfo不需要它
+	magnetInfoHash [20]byte
+}
+
+// NewMagnetMetaInfo 用magnet链接里携带的info_hash构造一个还没有info字典的MetaInfo，
+// 调用方应在后续通过BEP 9 ut_metadata抓到完整info字典后把它填进Info字段
+func NewMagnetMetaInfo(infoHash [20]byte) *MetaInfo {
+	return &MetaInfo{magnetInfoHash: infoHash}
+}
+
+// GetInfoHash 返回info字典的SHA-1哈希，用作种子的唯一标识。magnet链接在Info字典抓取
+// 完成前Info为nil，这段时间内回退返回构造时记录的info_hash，避免握手、DHT查找等在
+// metadata到手之前就发生的调用对nil的Info解引用
+func (m *MetaInfo) GetInfoHash() [20]byte {
+	if m.Info == nil {
+		return m.magnetInfoHash
+	}
+	return sha1.Sum(m.Info.raw)
+}
+
+// InfoSize 返回bencode编码后的info字典字节数，magnet链接握手时通过metadata_size提前告知对方
+func (m *MetaInfo) InfoSize() int64 {
+	if m.Info == nil {
+		return 0
+	}
+	return int64(len(m.Info.raw))
+}
+
+// ParseInfo 把BEP 9 ut_metadata拿回来的原始bencode info字典解析成Info，
+// 调用方需要先校验其SHA-1等于magnet链接里的info_hash
+func ParseInfo(raw []byte) (*Info, error) {
+	v, err := bencode.Unmarshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("metainfo: malformed info dict")
+	}
+	info := &Info{raw: raw}
+	if name, ok := d["name"].(string); ok {
+		info.Name = name
+	}
+	if pieceLength, ok := d["piece length"].(int64); ok {
+		info.PieceLength = pieceLength
+	}
+	if piecesStr, ok := d["pieces"].(string); ok {
+		piecesBuf := []byte(piecesStr)
+		for i := 0; i+20 <= len(piecesBuf); i += 20 {
+			var h [20]byte
+			copy(h[:], piecesBuf[i:i+20])
+			info.Pieces = append(info.Pieces, h)
+		}
+	}
+	if length, ok := d["length"].(int64); ok {
+		// 单文件种子
+		info.Length = length
+	} else if files, ok := d["files"].([]interface{}); ok {
+		// 多文件种子
+		for _, f := range files {
+			fd, ok := f.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			fileLength, _ := fd["length"].(int64)
+			pathList, _ := fd["path"].([]interface{})
+			path := make([]string, 0, len(pathList))
+			for _, p := range pathList {
+				if s, ok := p.(string); ok {
+					path = append(path, s)
+				}
+			}
+			info.Files = append(info.Files, &file{Length: fileLength, Path: path})
+			info.Length += fileLength
+		}
+	}
+	return info, nil
+}
+
+// GetPieceLength 返回指定piece的实际长度，最后一个piece可能小于标准PieceLength
+func (m *MetaInfo) GetPieceLength(index int) int {
+	if index == len(m.Info.Pieces)-1 {
+		last := m.Info.Length
+		if total := m.GetFileDetails(); len(total) > 0 {
+			last = total[len(total)-1].End
+		}
+		if rem := last % m.Info.PieceLength; rem != 0 {
+			return int(rem)
+		}
+	}
+	return int(m.Info.PieceLength)
+}
+
+// GetFileDetails 返回每个文件在整个种子数据流中的偏移范围
+func (m *MetaInfo) GetFileDetails() []*FileDetail {
+	fds := make([]*FileDetail, 0, len(m.Info.Files))
+	var offset int64
+	for _, f := range m.Info.Files {
+		fds = append(fds, &FileDetail{
+			Path:  f.Path,
+			Begin: offset,
+			End:   offset + f.Length,
+		})
+		offset += f.Length
+	}
+	return fds
+}
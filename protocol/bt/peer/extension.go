@@ -0,0 +1,18 @@
+package peer
+
+// extensionProtocolByte/extensionProtocolBit 是BEP 10规定的标记位：reserved字节数组第5个字节(从0开始)的0x10位
+// 置1表示该端支持扩展协议(Extended Messaging)
+// see https://www.bittorrent.org/beps/bep_0010.html
+const extensionProtocolByte = 5
+const extensionProtocolBit = 0x10
+
+// WithExtensionProtocol 在握手的reserved字节上置位，声明本端支持BEP 10扩展协议
+func WithExtensionProtocol(reserved [8]byte) [8]byte {
+	reserved[extensionProtocolByte] |= extensionProtocolBit
+	return reserved
+}
+
+// SupportsExtensionProtocol 判断对方握手声明的reserved字节是否支持BEP 10扩展协议
+func SupportsExtensionProtocol(reserved [8]byte) bool {
+	return reserved[extensionProtocolByte]&extensionProtocolBit != 0
+}
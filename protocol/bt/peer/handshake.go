@@ -0,0 +1,54 @@
+package peer
+
+import (
+	"errors"
+)
+
+const pstr = "BitTorrent protocol"
+
+// Handshake Peer wire protocol的握手消息
+// see https://wiki.theory.org/index.php/BitTorrentSpecification#Handshake
+type Handshake struct {
+	Pstr     string
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+func NewHandshake(reserved [8]byte, infoHash [20]byte, peerID [20]byte) *Handshake {
+	return &Handshake{
+		Pstr:     pstr,
+		Reserved: reserved,
+		InfoHash: infoHash,
+		PeerID:   peerID,
+	}
+}
+
+func (h *Handshake) Encode() []byte {
+	buf := make([]byte, 0, 49+len(h.Pstr))
+	buf = append(buf, byte(len(h.Pstr)))
+	buf = append(buf, h.Pstr...)
+	buf = append(buf, h.Reserved[:]...)
+	buf = append(buf, h.InfoHash[:]...)
+	buf = append(buf, h.PeerID[:]...)
+	return buf
+}
+
+func (h *Handshake) Decode(buf []byte) error {
+	if len(buf) < 1 {
+		return errors.New("handshake: empty buffer")
+	}
+	pstrLen := int(buf[0])
+	if len(buf) < 1+pstrLen+8+20+20 {
+		return errors.New("handshake: buffer too short")
+	}
+	offset := 1
+	h.Pstr = string(buf[offset : offset+pstrLen])
+	offset += pstrLen
+	copy(h.Reserved[:], buf[offset:offset+8])
+	offset += 8
+	copy(h.InfoHash[:], buf[offset:offset+20])
+	offset += 20
+	copy(h.PeerID[:], buf[offset:offset+20])
+	return nil
+}
@@ -0,0 +1,78 @@
+package message
+
+import (
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+)
+
+// ExtendedHandshakeID 是BEP 10规定的扩展握手消息固定用的扩展id，其余扩展的id由双方在
+// 握手的"m"字典里自行约定
+const ExtendedHandshakeID = 0
+
+// ExtendedHandshake 是BEP 10定义的握手消息，m字段声明"扩展名字->本端用来标识该扩展的id"，
+// metadata_size在支持ut_metadata时用于提前告知info字典的大小
+type ExtendedHandshake struct {
+	M            map[string]int64
+	MetadataSize int64
+	V            string
+}
+
+func NewExtendedHandshake(m map[string]int64, metadataSize int64) *ExtendedHandshake {
+	return &ExtendedHandshake{M: m, MetadataSize: metadataSize, V: "gopeed"}
+}
+
+func (h *ExtendedHandshake) Encode() []byte {
+	m := make(map[string]interface{}, len(h.M))
+	for name, id := range h.M {
+		m[name] = id
+	}
+	d := map[string]interface{}{
+		"m": m,
+		"v": h.V,
+	}
+	if h.MetadataSize > 0 {
+		d["metadata_size"] = h.MetadataSize
+	}
+	payload, _ := bencode.Marshal(d)
+	return BuildExtended(ExtendedHandshakeID, payload)
+}
+
+func DecodeExtendedHandshake(payload []byte) (*ExtendedHandshake, error) {
+	v, err := bencode.Unmarshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	d, _ := v.(map[string]interface{})
+	h := &ExtendedHandshake{M: make(map[string]int64)}
+	if m, ok := d["m"].(map[string]interface{}); ok {
+		for name, id := range m {
+			if n, ok := id.(int64); ok {
+				h.M[name] = n
+			}
+		}
+	}
+	if size, ok := d["metadata_size"].(int64); ok {
+		h.MetadataSize = size
+	}
+	if v, ok := d["v"].(string); ok {
+		h.V = v
+	}
+	return h, nil
+}
+
+// ExtendedID 返回该消息携带的扩展id（第一个字节），用于在IdExtended外层分发到具体扩展
+func ExtendedID(buf []byte) byte {
+	return buf[5]
+}
+
+// ExtendedPayload 返回扩展id之后的实际payload
+func ExtendedPayload(buf []byte) []byte {
+	return buf[6:]
+}
+
+// BuildExtended 按"本地协商的扩展id + 扩展自己的payload"组装一条IdExtended消息
+func BuildExtended(localID byte, payload []byte) []byte {
+	body := make([]byte, 1+len(payload))
+	body[0] = localID
+	copy(body[1:], payload)
+	return encode(IdExtended, body)
+}
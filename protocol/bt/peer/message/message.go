@@ -0,0 +1,177 @@
+package message
+
+import (
+	"bufio"
+	"encoding/binary"
+
+	"github.com/RoaringBitmap/roaring"
+)
+
+// ID 消息类型ID，定义见Peer wire protocol
+// see https://wiki.theory.org/index.php/BitTorrentSpecification#Messages
+type ID byte
+
+const (
+	IdChoke ID = iota
+	IdUnchoke
+	IdInterested
+	IdNotInterested
+	IdHave
+	IdBitfield
+	IdRequest
+	IdPiece
+	IdCancel
+	IdPort
+	IdExtended ID = 20
+)
+
+// SplitMessage 是bufio.Scanner的SplitFunc，按"4字节长度前缀+消息体"切分TCP流
+func SplitMessage(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if len(data) < 4 {
+		if atEOF && len(data) > 0 {
+			return 0, nil, bufio.ErrFinalToken
+		}
+		return 0, nil, nil
+	}
+	length := int(binary.BigEndian.Uint32(data[:4]))
+	if len(data) < 4+length {
+		return 0, nil, nil
+	}
+	return 4 + length, data[:4+length], nil
+}
+
+func encode(id ID, payload []byte) []byte {
+	buf := make([]byte, 4+1+len(payload))
+	binary.BigEndian.PutUint32(buf[:4], uint32(1+len(payload)))
+	buf[4] = byte(id)
+	copy(buf[5:], payload)
+	return buf
+}
+
+type simpleMessage struct {
+	id      ID
+	payload []byte
+}
+
+func (m *simpleMessage) Encode() []byte {
+	return encode(m.id, m.payload)
+}
+
+func NewChoke() *simpleMessage         { return &simpleMessage{id: IdChoke} }
+func NewUnchoke() *simpleMessage       { return &simpleMessage{id: IdUnchoke} }
+func NewInterested() *simpleMessage    { return &simpleMessage{id: IdInterested} }
+func NewNotInterested() *simpleMessage { return &simpleMessage{id: IdNotInterested} }
+
+func NewHave(index uint32) *simpleMessage {
+	payload := make([]byte, 4)
+	binary.BigEndian.PutUint32(payload, index)
+	return &simpleMessage{id: IdHave, payload: payload}
+}
+
+// Request request/cancel共用的index+begin+length载荷
+type Request struct {
+	Index  uint32
+	Begin  uint32
+	Length uint32
+}
+
+func BuildRequest(index, begin, length uint32) *Request {
+	return &Request{Index: index, Begin: begin, Length: length}
+}
+
+func (r *Request) Encode() []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], r.Index)
+	binary.BigEndian.PutUint32(payload[4:8], r.Begin)
+	binary.BigEndian.PutUint32(payload[8:12], r.Length)
+	return encode(IdRequest, payload)
+}
+
+func (r *Request) Decode(buf []byte) {
+	payload := buf[5:]
+	r.Index = binary.BigEndian.Uint32(payload[0:4])
+	r.Begin = binary.BigEndian.Uint32(payload[4:8])
+	r.Length = binary.BigEndian.Uint32(payload[8:12])
+}
+
+func BuildCancel(index, begin, length uint32) *Request {
+	return &Request{Index: index, Begin: begin, Length: length}
+}
+
+func (r *Request) EncodeCancel() []byte {
+	payload := make([]byte, 12)
+	binary.BigEndian.PutUint32(payload[0:4], r.Index)
+	binary.BigEndian.PutUint32(payload[4:8], r.Begin)
+	binary.BigEndian.PutUint32(payload[8:12], r.Length)
+	return encode(IdCancel, payload)
+}
+
+// Piece 响应Request的实际数据块
+type Piece struct {
+	Index uint32
+	Begin uint32
+	Block []byte
+}
+
+func NewPiece() *Piece {
+	return &Piece{}
+}
+
+func BuildPiece(index, begin uint32, block []byte) *Piece {
+	return &Piece{Index: index, Begin: begin, Block: block}
+}
+
+func (p *Piece) Encode() []byte {
+	payload := make([]byte, 8+len(p.Block))
+	binary.BigEndian.PutUint32(payload[0:4], p.Index)
+	binary.BigEndian.PutUint32(payload[4:8], p.Begin)
+	copy(payload[8:], p.Block)
+	return encode(IdPiece, payload)
+}
+
+func (p *Piece) Decode(buf []byte) {
+	payload := buf[5:]
+	p.Index = binary.BigEndian.Uint32(payload[0:4])
+	p.Begin = binary.BigEndian.Uint32(payload[4:8])
+	p.Block = payload[8:]
+}
+
+// Bitfield 表示一个peer已拥有的piece集合
+type Bitfield struct {
+	bitmap *roaring.Bitmap
+}
+
+func NewBitfield() *Bitfield {
+	return &Bitfield{bitmap: roaring.New()}
+}
+
+func (b *Bitfield) Decode(buf []byte) {
+	payload := buf[5:]
+	b.bitmap = roaring.New()
+	for i, by := range payload {
+		for bit := 0; bit < 8; bit++ {
+			if by&(0x80>>uint(bit)) != 0 {
+				b.bitmap.AddInt(i*8 + bit)
+			}
+		}
+	}
+}
+
+// Provide 返回bitfield中拥有、但had(本地已完成的piece集合)中没有的piece
+func (b *Bitfield) Provide(had *roaring.Bitmap) []uint32 {
+	want := roaring.AndNot(b.bitmap, had)
+	result := make([]uint32, 0, want.GetCardinality())
+	it := want.Iterator()
+	for it.HasNext() {
+		result = append(result, it.Next())
+	}
+	return result
+}
+
+func (b *Bitfield) Has(index int) bool {
+	return b.bitmap.ContainsInt(index)
+}
+
+func (b *Bitfield) Set(index int) {
+	b.bitmap.AddInt(index)
+}
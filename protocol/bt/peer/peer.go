@@ -0,0 +1,36 @@
+package peer
+
+import (
+	"fmt"
+	"net"
+)
+
+// Source 标识一个Peer是通过什么途径被发现的
+type Source string
+
+const (
+	SourceTracker  Source = "tracker"
+	SourceDHT      Source = "dht"
+	SourcePEX      Source = "pex"
+	SourceIncoming Source = "incoming"
+)
+
+// Peer 代表swarm中的一个远程节点
+type Peer struct {
+	IP   net.IP
+	Port uint16
+	// Source 记录该Peer最初是从tracker、DHT、PEX还是主动连入发现的，便于统计和调试
+	Source Source
+}
+
+func NewPeer(ip net.IP, port uint16, source Source) *Peer {
+	return &Peer{
+		IP:     ip,
+		Port:   port,
+		Source: source,
+	}
+}
+
+func (p *Peer) Address() string {
+	return fmt.Sprintf("%s:%d", p.IP.String(), p.Port)
+}
@@ -0,0 +1,95 @@
+package torrent
+
+import (
+	"sort"
+	"time"
+)
+
+// 每次choke轮换解除的peer数量（tit-for-tat核心人数），以及乐观unchoke轮换周期
+const (
+	unchokeSlots       = 4
+	chokeInterval      = 10 * time.Second
+	optimisticInterval = 30 * time.Second
+)
+
+// chokeController 实现标准BitTorrent的tit-for-tat：按下载速率挑选出固定数量的peer长期unchoke，
+// 并每30秒额外轮换一个乐观unchoke名额，给新连接的peer一个证明自己的机会
+type chokeController struct {
+	torrent   *Torrent
+	stopCh    chan struct{}
+	optimisti int
+	// 当前占用乐观unchoke名额的peer，rebalance在下一次轮换前不会choke它
+	optimisticPC *peerConn
+}
+
+func newChokeController(t *Torrent) *chokeController {
+	return &chokeController{torrent: t, stopCh: make(chan struct{})}
+}
+
+func (c *chokeController) run() {
+	chokeTicker := time.NewTicker(chokeInterval)
+	optimisticTicker := time.NewTicker(optimisticInterval)
+	defer chokeTicker.Stop()
+	defer optimisticTicker.Stop()
+	for {
+		select {
+		case <-chokeTicker.C:
+			c.rebalance()
+		case <-optimisticTicker.C:
+			c.rotateOptimistic()
+		case <-c.stopCh:
+			return
+		}
+	}
+}
+
+func (c *chokeController) stop() {
+	close(c.stopCh)
+}
+
+// rebalance 按下载速率对所有对我们感兴趣的peer排序，unchoke前unchokeSlots个，其余choke
+func (c *chokeController) rebalance() {
+	conns := c.torrent.peerConns()
+	interested := make([]*peerConn, 0, len(conns))
+	for _, pc := range conns {
+		if pc.peerInterested {
+			interested = append(interested, pc)
+		}
+	}
+	sort.Slice(interested, func(i, j int) bool {
+		return interested[i].stats.downloadRate() > interested[j].stats.downloadRate()
+	})
+
+	unchoked := unchokeSlots
+	if unchoked > len(interested) {
+		unchoked = len(interested)
+	}
+	for i, pc := range interested {
+		if i < unchoked {
+			pc.unchoke()
+		} else if pc != c.optimisticPC {
+			pc.choke()
+		}
+	}
+	for _, pc := range conns {
+		if !pc.peerInterested {
+			pc.choke()
+		}
+	}
+}
+
+// rotateOptimistic 按轮换顺序挑下一个peer，若它对我们感兴趣就unchoke并占住乐观名额直到下一次轮换，
+// 让它有机会证明自己的上传能力从而进入rebalance的常规名单
+func (c *chokeController) rotateOptimistic() {
+	conns := c.torrent.peerConns()
+	c.optimisticPC = nil
+	if len(conns) == 0 {
+		return
+	}
+	c.optimisti = (c.optimisti + 1) % len(conns)
+	pc := conns[c.optimisti]
+	if pc.peerInterested {
+		pc.unchoke()
+		c.optimisticPC = pc
+	}
+}
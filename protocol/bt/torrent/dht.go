@@ -0,0 +1,44 @@
+package torrent
+
+import (
+	"github.com/monkeyWie/gopeed/protocol/bt/dht"
+	"github.com/monkeyWie/gopeed/protocol/bt/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// startDHT 启动（或复用该种子已有的）DHT实例，为当前种子的info_hash执行get_peers查找，
+// 并把拿到的peer地址喂给tracker用的同一个peer池，来源标记为PeerSource为dht，方便和tracker/pex区分
+func (t *Torrent) startDHT() {
+	if t.dht == nil {
+		t.dht = dht.New("")
+		if err := t.dht.Run(); err != nil {
+			log.Errorf("dht: start failed: %v", err)
+			t.dht = nil
+			return
+		}
+	}
+	go t.runDHTLookup()
+}
+
+func (t *Torrent) runDHTLookup() {
+	addrs, err := t.dht.GetPeers(t.MetaInfo.GetInfoHash())
+	if err != nil {
+		log.Debugf("dht: get_peers failed: %v", err)
+		return
+	}
+	peers := make([]*peer.Peer, 0, len(addrs))
+	for _, addr := range addrs {
+		peers = append(peers, peer.NewPeer(addr.IP, uint16(addr.Port), peer.SourceDHT))
+	}
+	if len(peers) > 0 {
+		t.addPeers(peers)
+	}
+}
+
+// stopDHT 在种子停止时关闭DHT监听
+func (t *Torrent) stopDHT() {
+	if t.dht != nil {
+		t.dht.Close()
+		t.dht = nil
+	}
+}
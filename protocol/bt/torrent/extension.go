@@ -0,0 +1,69 @@
+package torrent
+
+import (
+	"sort"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/peer/message"
+	log "github.com/sirupsen/logrus"
+)
+
+// extensionHandler 处理某个已协商扩展收到的payload，payload已经剥离了扩展id这一个字节
+type extensionHandler func(pc *peerConn, payload []byte)
+
+// extensionRegistry 记录本客户端支持的所有BEP 10扩展，key是BEP 10里约定的扩展名字
+// (如ut_metadata、ut_pex)，由各扩展自己的文件通过registerExtension在init()里注册
+var extensionRegistry = map[string]extensionHandler{}
+
+func registerExtension(name string, handler extensionHandler) {
+	extensionRegistry[name] = handler
+}
+
+// localExtensionTable 把本地支持的扩展按名字排序后分配固定的本地id(从1开始，0保留给握手本身)，
+// 排序只是为了同一个进程内id稳定，方便调试
+func localExtensionTable() map[string]int64 {
+	names := make([]string, 0, len(extensionRegistry))
+	for name := range extensionRegistry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	table := make(map[string]int64, len(names))
+	for i, name := range names {
+		table[name] = int64(i + 1)
+	}
+	return table
+}
+
+// sendExtendedHandshake 在确认对方支持扩展协议后，发送BEP 10握手声明我们支持哪些扩展
+func (pc *peerConn) sendExtendedHandshake() {
+	pc.localExtensions = localExtensionTable()
+	var metadataSize int64
+	if pc.torrent.MetaInfo != nil && pc.torrent.MetaInfo.Info != nil {
+		metadataSize = pc.torrent.MetaInfo.InfoSize()
+	}
+	pc.conn.Write(message.NewExtendedHandshake(pc.localExtensions, metadataSize).Encode())
+}
+
+// handleExtended 分发收到的IdExtended消息：扩展id 0是BEP 10握手本身，
+// 其它id按本端在握手里声明的"m"字典(localExtensions)，路由给已注册的扩展处理器
+func (pc *peerConn) handleExtended(buf []byte) {
+	extID := message.ExtendedID(buf)
+	payload := message.ExtendedPayload(buf)
+	if extID == message.ExtendedHandshakeID {
+		handshake, err := message.DecodeExtendedHandshake(payload)
+		if err != nil {
+			log.Debugf("extended handshake decode error: %v", err)
+			return
+		}
+		pc.peerExtensions = handshake.M
+		pc.onExtendedHandshake(handshake)
+		return
+	}
+	for name, id := range pc.localExtensions {
+		if int64(extID) == id {
+			if handler, ok := extensionRegistry[name]; ok {
+				handler(pc, payload)
+			}
+			return
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package torrent
+
+// Start 启动一个种子真正参与BT网络所需的后台流程：没有它，种子只会被动挂着——
+// tit-for-tat choke控制器不跑的话amChoking永远是握手时的初始值true，等于对谁都不上传；
+// DHT不启动的话chunk0-1加的那套peer发现也永远不会被触发。下载/上传本身仍由各个
+// peerConn的ready()/downloadPiece()驱动，这里只负责这些种子级别后台协程的生命周期
+func (t *Torrent) Start() {
+	t.chokeCtrl = newChokeController(t)
+	go t.chokeCtrl.run()
+
+	t.startDHT()
+
+	// 同样没人调用就永远不会触发的连接reaper：连接数超过MaxConnections时靠它
+	// 把那些通过了keepalive检测、但实际上不怎么传数据的连接淘汰掉，见stats.go
+	t.connReaperStop = make(chan struct{})
+	go t.runConnReaper(t.connReaperStop)
+}
+
+// Stop 停止Start启动的所有后台协程
+func (t *Torrent) Stop() {
+	if t.chokeCtrl != nil {
+		t.chokeCtrl.stop()
+		t.chokeCtrl = nil
+	}
+	t.stopDHT()
+	if t.connReaperStop != nil {
+		close(t.connReaperStop)
+		t.connReaperStop = nil
+	}
+}
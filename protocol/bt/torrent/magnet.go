@@ -0,0 +1,75 @@
+package torrent
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Magnet 是解析后的磁力链接，对应 magnet:?xt=urn:btih:<info_hash>&dn=<name>&tr=<tracker>...
+type Magnet struct {
+	InfoHash    [20]byte
+	DisplayName string
+	Trackers    []string
+}
+
+var errInvalidMagnet = errors.New("torrent: invalid magnet uri")
+
+// ParseMagnet 解析一个magnet URI，info_hash既支持hex(40字符)也支持base32(32字符)两种常见写法
+func ParseMagnet(uri string) (*Magnet, error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "magnet" {
+		return nil, errInvalidMagnet
+	}
+	query := u.Query()
+	var infoHash [20]byte
+	found := false
+	for _, xt := range query["xt"] {
+		const prefix = "urn:btih:"
+		if !strings.HasPrefix(xt, prefix) {
+			continue
+		}
+		hashStr := xt[len(prefix):]
+		raw, err := decodeInfoHash(hashStr)
+		if err != nil {
+			return nil, err
+		}
+		infoHash = raw
+		found = true
+		break
+	}
+	if !found {
+		return nil, errInvalidMagnet
+	}
+	return &Magnet{
+		InfoHash:    infoHash,
+		DisplayName: query.Get("dn"),
+		Trackers:    query["tr"],
+	}, nil
+}
+
+func decodeInfoHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	switch len(s) {
+	case 40:
+		raw, err := hex.DecodeString(s)
+		if err != nil {
+			return hash, err
+		}
+		copy(hash[:], raw)
+	case 32:
+		raw, err := base32.StdEncoding.DecodeString(strings.ToUpper(s))
+		if err != nil {
+			return hash, err
+		}
+		copy(hash[:], raw)
+	default:
+		return hash, errInvalidMagnet
+	}
+	return hash, nil
+}
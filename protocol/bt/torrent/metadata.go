@@ -0,0 +1,247 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+	"github.com/monkeyWie/gopeed/protocol/bt/metainfo"
+	"github.com/monkeyWie/gopeed/protocol/bt/peer/message"
+	log "github.com/sirupsen/logrus"
+)
+
+var errNoMetadataExtension = errors.New("torrent: peer does not support ut_metadata")
+
+// ut_metadata (BEP 9) 扩展名，用来在双方都只知道magnet链接、没有.torrent文件时交换info字典
+const extUTMetadata = "ut_metadata"
+
+// ut_metadata三种msg_type
+const (
+	metadataMsgRequest = 0
+	metadataMsgData    = 1
+	metadataMsgReject  = 2
+)
+
+// metadataPieceSize 是BEP 9规定的每个metadata piece的大小，最后一片可以更短
+const metadataPieceSize = 16 * 1024
+
+// metadataRequestTimeout 发出一个metadata piece请求后最多等待多久还没收到响应（data或reject）
+// 就认为这次请求石沉大海，换一片继续；避免在等待异步响应期间原地反复重发同一个piece
+const metadataRequestTimeout = 10 * time.Second
+
+func init() {
+	registerExtension(extUTMetadata, handleUTMetadata)
+}
+
+// metadataFetcher 负责把远端peer逐片发来的info字典拼成完整的原始bencode数据，
+// 多个peer可以并发地参与同一次抓取，用mutex保护共享的piece表
+type metadataFetcher struct {
+	mu         sync.Mutex
+	size       int64
+	pieceCount int
+	pieces     [][]byte
+	rejected   map[int]bool
+	remaining  int
+	doneCh     chan struct{}
+	closed     bool
+	// updateCh在每次setPiece/markRejected之后被关闭并替换为一个新的channel，
+	// 相当于一个用channel实现的广播式条件变量，唤醒所有在awaitPiece里等待的goroutine
+	updateCh chan struct{}
+}
+
+func newMetadataFetcher(size int64) *metadataFetcher {
+	pieceCount := int((size + metadataPieceSize - 1) / metadataPieceSize)
+	return &metadataFetcher{
+		size:       size,
+		pieceCount: pieceCount,
+		pieces:     make([][]byte, pieceCount),
+		rejected:   make(map[int]bool),
+		remaining:  pieceCount,
+		doneCh:     make(chan struct{}),
+		updateCh:   make(chan struct{}),
+	}
+}
+
+func (f *metadataFetcher) notifyLocked() {
+	close(f.updateCh)
+	f.updateCh = make(chan struct{})
+}
+
+// nextMissingPiece 返回一个还没有收到、且不在skip里的piece索引，没有则返回-1。
+// skip由调用方维护，记录这个peer已经reject过的piece，换一个peer可能还要得到
+func (f *metadataFetcher) nextMissingPiece(skip map[int]bool) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, p := range f.pieces {
+		if p == nil && !skip[i] {
+			return i
+		}
+	}
+	return -1
+}
+
+// setPiece 记录一片metadata，所有piece到齐后拼接并返回完整的info字典原始字节；
+// SHA-1校验不在这里做，由onMetadataComplete负责
+func (f *metadataFetcher) setPiece(index int, data []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed || index < 0 || index >= len(f.pieces) || f.pieces[index] != nil {
+		return nil
+	}
+	f.pieces[index] = data
+	f.remaining--
+	f.notifyLocked()
+	if f.remaining > 0 {
+		return nil
+	}
+	raw := make([]byte, 0, f.size)
+	for _, p := range f.pieces {
+		raw = append(raw, p...)
+	}
+	f.closed = true
+	close(f.doneCh)
+	return raw
+}
+
+// markRejected 记录对方拒绝了某个piece，并唤醒等待中的awaitPiece
+func (f *metadataFetcher) markRejected(index int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if index >= 0 && index < len(f.pieces) {
+		f.rejected[index] = true
+	}
+	f.notifyLocked()
+}
+
+// awaitPiece 阻塞直到index这一片到手、被对方reject、整体抓取结束，或者超过timeout还没
+// 等到任何动静，四种情况都直接返回，不反复重发同一个还在等回应的请求
+func (f *metadataFetcher) awaitPiece(index int, timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		f.mu.Lock()
+		settled := f.pieces[index] != nil || f.rejected[index] || f.closed
+		updateCh := f.updateCh
+		f.mu.Unlock()
+		if settled {
+			return
+		}
+		select {
+		case <-updateCh:
+		case <-timer.C:
+			return
+		case <-f.doneCh:
+			return
+		}
+	}
+}
+
+func (f *metadataFetcher) isRejected(index int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.rejected[index]
+}
+
+// onExtendedHandshake 在BEP 10握手完成后触发，按对方声明支持的扩展启动对应的后续流程
+func (pc *peerConn) onExtendedHandshake(handshake *message.ExtendedHandshake) {
+	if _, ok := handshake.M[extUTMetadata]; ok && pc.torrent.MetaInfo.Info == nil && handshake.MetadataSize > 0 {
+		if pc.torrent.metadata == nil {
+			pc.torrent.metadata = newMetadataFetcher(handshake.MetadataSize)
+		}
+		go pc.fetchMetadata()
+	}
+	if _, ok := handshake.M[extUTPex]; ok {
+		go pc.runPEX()
+	}
+}
+
+// fetchMetadata 持续向该peer请求还缺的metadata piece，直到抓取完成或连接断开。
+// 每次请求后都等待这一片到手/被拒绝/超时才继续下一片，避免在等待对方异步响应期间
+// 原地对同一个还没回应的piece反复重发；对方reject过的piece记在本地skip里，不再找它要
+func (pc *peerConn) fetchMetadata() {
+	fetcher := pc.torrent.metadata
+	skip := make(map[int]bool)
+	for {
+		select {
+		case <-fetcher.doneCh:
+			return
+		case <-pc.disconnectCh:
+			return
+		default:
+		}
+		index := fetcher.nextMissingPiece(skip)
+		if index < 0 {
+			return
+		}
+		if err := pc.requestMetadataPiece(index); err != nil {
+			return
+		}
+		fetcher.awaitPiece(index, metadataRequestTimeout)
+		if fetcher.isRejected(index) {
+			skip[index] = true
+		}
+	}
+}
+
+func (pc *peerConn) requestMetadataPiece(index int) error {
+	remoteID, ok := pc.peerExtensions[extUTMetadata]
+	if !ok {
+		return errNoMetadataExtension
+	}
+	payload, _ := bencode.Marshal(map[string]interface{}{
+		"msg_type": int64(metadataMsgRequest),
+		"piece":    int64(index),
+	})
+	_, err := pc.conn.Write(message.BuildExtended(byte(remoteID), payload))
+	return err
+}
+
+// handleUTMetadata 处理收到的ut_metadata扩展消息：request就忽略(本实现暂不提供metadata做种)，
+// data就把这一片交给fetcher，凑齐后校验SHA-1并构造MetaInfo
+func handleUTMetadata(pc *peerConn, payload []byte) {
+	v, rest, err := bencode.UnmarshalPrefix(payload)
+	if err != nil {
+		return
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	msgType, _ := d["msg_type"].(int64)
+	piece, _ := d["piece"].(int64)
+	switch msgType {
+	case metadataMsgData:
+		if pc.torrent.metadata == nil {
+			return
+		}
+		raw := pc.torrent.metadata.setPiece(int(piece), rest)
+		if raw == nil {
+			return
+		}
+		pc.onMetadataComplete(raw)
+	case metadataMsgReject:
+		log.Debugf("peer rejected ut_metadata piece %d", piece)
+		if pc.torrent.metadata != nil {
+			pc.torrent.metadata.markRejected(int(piece))
+		}
+	}
+}
+
+// onMetadataComplete 校验拼好的info字典哈希与magnet的info_hash一致后，构造MetaInfo.Info
+// 并初始化pieceStates，种子从此进入和有.torrent文件时一样的下载流程
+func (pc *peerConn) onMetadataComplete(raw []byte) {
+	if sha1.Sum(raw) != pc.torrent.MetaInfo.GetInfoHash() {
+		log.Warnf("ut_metadata info_hash mismatch, discarding")
+		pc.torrent.metadata = nil
+		return
+	}
+	info, err := metainfo.ParseInfo(raw)
+	if err != nil {
+		log.Warnf("ut_metadata parse failed: %v", err)
+		return
+	}
+	pc.torrent.MetaInfo.Info = info
+	pc.torrent.initPieceStates()
+}
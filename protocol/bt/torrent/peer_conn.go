@@ -12,6 +12,7 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"time"
 
 	"github.com/cenkalti/mse"
@@ -26,6 +27,7 @@ const blockSize = 2 << 13
 const keepaliveTimeout = 60 * 2
 
 var errPieceCheckFailed = errors.New("piece check failed")
+var errPieceCancelled = errors.New("torrent: piece download cancelled by priority change")
 var keepaliveData = make([]byte, 4)
 
 type peerConn struct {
@@ -51,12 +53,34 @@ type peerConn struct {
 	disconnectCh chan error
 	// block下载队列，官方推荐为5
 	blockQueueCh chan interface{}
+
+	// 对方请求、等待我们上传的block队列
+	uploadMu    sync.Mutex
+	uploadQueue []*message.Request
+
+	// 字节/速率统计，供choke控制器排名和Torrent.Stats()使用，见stats.go
+	stats ConnStats
+
+	// BEP 10扩展协议相关状态，见extension.go
+	peerSupportsExtended bool
+	localExtensions      map[string]int64
+	peerExtensions       map[string]int64
+	metadata             *metadataFetcher
+	pex                  *pexState
+
+	// 当前正在从该peer下载的piece及其已发出、尚未收到响应的block请求，
+	// 供piece picker的cancelPiece精确取消（而不是瞎猜一个固定的begin/length），见piece_picker.go
+	reqMu         sync.Mutex
+	downloadIndex int
+	pending       []*message.Request
+	abortCh       chan struct{}
 }
 
 func newPeerConn(torrent *Torrent, peer *peer.Peer) *peerConn {
 	return &peerConn{
-		torrent: torrent,
-		peer:    peer,
+		torrent:       torrent,
+		peer:          peer,
+		downloadIndex: -1,
 	}
 }
 
@@ -82,7 +106,7 @@ func (pc *peerConn) dialMse() error {
 // see https://wiki.theory.org/index.php/BitTorrentSpecification#Handshake
 func (pc *peerConn) handshake() (*peer.Handshake, error) {
 	handshakeRes, err := func() (*peer.Handshake, error) {
-		handshakeReq := peer.NewHandshake([8]byte{}, pc.torrent.MetaInfo.GetInfoHash(), pc.torrent.PeerID)
+		handshakeReq := peer.NewHandshake(peer.WithExtensionProtocol([8]byte{}), pc.torrent.MetaInfo.GetInfoHash(), pc.torrent.PeerID)
 		_, err := pc.conn.Write(handshakeReq.Encode())
 		if err != nil {
 			return nil, err
@@ -112,6 +136,7 @@ func (pc *peerConn) handshake() (*peer.Handshake, error) {
 	pc.amInterested = false
 	pc.peerChoking = true
 	pc.peerInterested = false
+	pc.peerSupportsExtended = peer.SupportsExtensionProtocol(handshakeRes.Reserved)
 	return handshakeRes, nil
 }
 
@@ -145,6 +170,9 @@ func (pc *peerConn) ready() error {
 	readyCh := make(chan bool)
 	pc.disconnectCh = make(chan error)
 	go pc.handleKeepalive()
+	if pc.peerSupportsExtended {
+		pc.sendExtendedHandshake()
+	}
 	go func() {
 		scanner := bufio.NewScanner(pc.conn)
 		scanner.Split(message.SplitMessage)
@@ -162,20 +190,28 @@ func (pc *peerConn) ready() error {
 					pc.handleUnchoke(readyCh)
 					break
 				case message.IdInterested:
+					pc.handleInterested()
 					break
 				case message.IdNotInterested:
+					pc.handleNotInterested()
 					break
 				case message.IdHave:
+					pc.handleHave(buf)
 					break
 				case message.IdBitfield:
 					pc.handleBitfield(buf)
 					break
 				case message.IdRequest:
+					pc.handleRequest(buf)
 					break
 				case message.IdPiece:
 					pc.handlePiece(buf)
 					break
 				case message.IdCancel:
+					pc.handleCancel(buf)
+					break
+				case message.IdExtended:
+					pc.handleExtended(buf)
 					break
 				}
 			}
@@ -208,7 +244,45 @@ func (pc *peerConn) ready() error {
 }
 
 // 下载指定piece
+// pickNextPiece 委托给picker，按稀有度（或endgame模式下的全量可选）挑一个piece下载
+func (pc *peerConn) pickNextPiece(inFlight map[int]bool) (int, bool) {
+	return pc.torrent.picker.PickPiece(pc, pc.bitfield, inFlight)
+}
+
+// runDownload 在连接ready之后持续挑片、逐片下载，直到没有更多可挑的piece或连接断开。
+// 这个连接一次只下载一个piece，所以不需要维护inFlight表
+func (pc *peerConn) runDownload() {
+	for {
+		index, ok := pc.pickNextPiece(nil)
+		if !ok {
+			select {
+			case <-pc.disconnectCh:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		if err := pc.downloadPiece(index); err != nil && err != errPieceCancelled {
+			return
+		}
+	}
+}
+
 func (pc *peerConn) downloadPiece(index int) (err error) {
+	pc.reqMu.Lock()
+	pc.downloadIndex = index
+	pc.pending = nil
+	pc.abortCh = make(chan struct{})
+	abortCh := pc.abortCh
+	pc.reqMu.Unlock()
+	defer func() {
+		pc.reqMu.Lock()
+		pc.downloadIndex = -1
+		pc.pending = nil
+		pc.abortCh = nil
+		pc.reqMu.Unlock()
+		pc.torrent.picker.ReleasePiece(index, pc)
+	}()
 	pieceLength := pc.torrent.MetaInfo.GetPieceLength(index)
 	pc.downloadedCh = make(chan error)
 	pc.blockQueueCh = make(chan interface{}, 5)
@@ -237,14 +311,23 @@ func (pc *peerConn) downloadPiece(index int) (err error) {
 			break
 		case err = <-pc.disconnectCh:
 			break
+		case <-abortCh:
+			err = errPieceCancelled
+			break
 		}
 		// 如果连接出现问题或下载失败直接返回异常
 		if err != nil {
-			pc.conn.Close()
+			if err != errPieceCancelled {
+				pc.conn.Close()
+			}
 			return
 		}
 		// 发起request，对方会响应piece
-		_, err = pc.conn.Write(message.BuildRequest(uint32(index), uint32(offset), blockLength).Encode())
+		req := message.BuildRequest(uint32(index), uint32(offset), blockLength)
+		pc.reqMu.Lock()
+		pc.pending = append(pc.pending, req)
+		pc.reqMu.Unlock()
+		_, err = pc.conn.Write(req.Encode())
 		if err != nil {
 			break
 		}
@@ -254,13 +337,76 @@ func (pc *peerConn) downloadPiece(index int) (err error) {
 		break
 	case err = <-pc.disconnectCh:
 		break
+	case <-abortCh:
+		err = errPieceCancelled
+		break
 	}
-	if err != nil {
+	if err != nil && err != errPieceCancelled {
 		pc.conn.Close()
 	}
 	return
 }
 
+// pickNextPiece 委托给picker，按稀有度（或endgame模式下的全量可选）挑一个piece下载
+func (pc *peerConn) pickNextPiece(inFlight map[int]bool) (int, bool) {
+	return pc.torrent.picker.PickPiece(pc, pc.bitfield, inFlight)
+}
+
+// runDownload 在连接ready之后持续挑片、逐片下载，直到没有更多可挑的piece或连接断开。
+// 这个连接一次只下载一个piece，所以不需要维护inFlight表
+func (pc *peerConn) runDownload() {
+	for {
+		index, ok := pc.pickNextPiece(nil)
+		if !ok {
+			select {
+			case <-pc.disconnectCh:
+				return
+			case <-time.After(time.Second):
+				continue
+			}
+		}
+		if err := pc.downloadPiece(index); err != nil && err != errPieceCancelled {
+			return
+		}
+	}
+}
+
+// cancelPiece 由piece picker在某个piece被降级到minPriority以下时调用：按这个连接
+// 实际发出、尚未收到响应的block请求逐个发Cancel（而不是猜一个固定的begin/length），
+// 并唤醒downloadPiece的等待循环，让这个连接的下载槽位立刻空出来去下载别的piece
+func (pc *peerConn) cancelPiece(index int) {
+	pc.reqMu.Lock()
+	if pc.downloadIndex != index || pc.abortCh == nil {
+		pc.reqMu.Unlock()
+		return
+	}
+	pending := pc.pending
+	abortCh := pc.abortCh
+	pc.reqMu.Unlock()
+
+	for _, req := range pending {
+		pc.conn.Write(message.BuildCancel(req.Index, req.Begin, req.Length).EncodeCancel())
+	}
+	select {
+	case <-abortCh:
+	default:
+		close(abortCh)
+	}
+}
+
+// removePending 在一个block的Piece响应到手后，把它从这个连接的在途请求表里摘掉，
+// 这样cancelPiece发出的Cancel才能精确匹配实际还没到手的请求
+func (pc *peerConn) removePending(index, begin, length uint32) {
+	pc.reqMu.Lock()
+	defer pc.reqMu.Unlock()
+	for i, req := range pc.pending {
+		if req.Index == index && req.Begin == begin && req.Length == length {
+			pc.pending = append(pc.pending[:i], pc.pending[i+1:]...)
+			return
+		}
+	}
+}
+
 func (pc *peerConn) handleUnchoke(readyCh chan<- bool) {
 	pc.peerChoking = false
 	// 已经处理过Unchoke信号
@@ -280,19 +426,155 @@ func (pc *peerConn) handleUnchoke(readyCh chan<- bool) {
 func (pc *peerConn) handleBitfield(buf []byte) {
 	pc.bitfield = message.NewBitfield()
 	pc.bitfield.Decode(buf)
+	pc.torrent.picker.onBitfield(pc.bitfield)
 	have := pc.getHavePieces(pc.bitfield)
 	if len(have) > 0 {
-		// 表示对该peer感兴趣，并且不choked该peer
+		// 表示对该peer感兴趣，是否unchoke交给choke控制器决定（见choke.go）
 		pc.conn.Write(message.NewInterested().Encode())
 		pc.amInterested = true
-
-		pc.conn.Write(message.NewUnchoke().Encode())
-		pc.amChoking = false
 	} else {
 		pc.conn.Close()
 	}
 }
 
+// 对方对我们感兴趣了，记录状态交给choke控制器在下一轮重新计算unchoke名单
+func (pc *peerConn) handleInterested() {
+	pc.peerInterested = true
+}
+
+func (pc *peerConn) handleNotInterested() {
+	pc.peerInterested = false
+}
+
+// 对方声明新下载了一个piece，更新其bitfield以便picker统计稀有度
+func (pc *peerConn) handleHave(buf []byte) {
+	if pc.bitfield == nil {
+		pc.bitfield = message.NewBitfield()
+	}
+	index := binary.BigEndian.Uint32(buf[5:9])
+	pc.bitfield.Set(int(index))
+	pc.torrent.picker.onHave(int(index), true)
+}
+
+// unchoke 由choke控制器调用，解除对该peer的choke并通知对方
+func (pc *peerConn) unchoke() {
+	if !pc.amChoking {
+		return
+	}
+	pc.amChoking = false
+	pc.conn.Write(message.NewUnchoke().Encode())
+}
+
+// choke 由choke控制器调用，choke该peer并清空尚未应答的上传队列
+func (pc *peerConn) choke() {
+	if pc.amChoking {
+		return
+	}
+	pc.amChoking = true
+	pc.conn.Write(message.NewChoke().Encode())
+	pc.uploadMu.Lock()
+	pc.uploadQueue = nil
+	pc.uploadMu.Unlock()
+}
+
+// handleRequest 处理对方的block请求：排队等待发送，若我们没有choke对方就读取本地文件并回复Piece
+func (pc *peerConn) handleRequest(buf []byte) {
+	req := &message.Request{}
+	req.Decode(buf)
+	if pc.amChoking {
+		// choking状态下忽略请求，符合协议预期
+		return
+	}
+	pc.uploadMu.Lock()
+	pc.uploadQueue = append(pc.uploadQueue, req)
+	pc.uploadMu.Unlock()
+	go pc.serveRequest(req)
+}
+
+// handleCancel 从待发送队列中移除一个已被对方取消的请求
+func (pc *peerConn) handleCancel(buf []byte) {
+	req := &message.Request{}
+	req.Decode(buf)
+	pc.uploadMu.Lock()
+	defer pc.uploadMu.Unlock()
+	for i, r := range pc.uploadQueue {
+		if r.Index == req.Index && r.Begin == req.Begin && r.Length == req.Length {
+			pc.uploadQueue = append(pc.uploadQueue[:i], pc.uploadQueue[i+1:]...)
+			return
+		}
+	}
+}
+
+// serveRequest 按请求读取本地已下载完成的文件数据并回复IdPiece，复用handlePiece写文件时的同一套偏移换算
+func (pc *peerConn) serveRequest(req *message.Request) {
+	block, err := pc.readBlock(int(req.Index), int64(req.Begin), int64(req.Length))
+	if err != nil {
+		log.Debugf("serve request piece:%d begin:%d error: %v", req.Index, req.Begin, err)
+		return
+	}
+	pc.uploadMu.Lock()
+	queued := false
+	for i, r := range pc.uploadQueue {
+		if r.Index == req.Index && r.Begin == req.Begin && r.Length == req.Length {
+			pc.uploadQueue = append(pc.uploadQueue[:i], pc.uploadQueue[i+1:]...)
+			queued = true
+			break
+		}
+	}
+	pc.uploadMu.Unlock()
+	if !queued {
+		// 读盘期间已被对方Cancel，或者我们choke了对方清空了队列，不再发送
+		return
+	}
+	pc.conn.Write(message.BuildPiece(req.Index, req.Begin, block).Encode())
+	pc.stats.addWritten(int64(len(block)))
+}
+
+// readBlock 按getWriteFile/fileBlock同样的偏移映射规则，从本地磁盘读出请求的block
+func (pc *peerConn) readBlock(index int, begin, length int64) ([]byte, error) {
+	info := pc.torrent.MetaInfo.Info
+	fds := pc.torrent.MetaInfo.GetFileDetails()
+	pieceBegin := int64(index)*info.PieceLength + begin
+	block := make([]byte, length)
+	if len(info.Files) == 0 {
+		name := filepath.Join(pc.torrent.Path, info.Name)
+		file, err := os.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		if _, err := file.ReadAt(block, pieceBegin); err != nil {
+			return nil, err
+		}
+		return block, nil
+	}
+	writeIndex := getWriteFile(pieceBegin, fds)
+	fileBegin := pieceBegin
+	var read int64
+	for _, f := range fds[writeIndex:] {
+		name := filepath.Join(pc.torrent.Path, filepath.Join(f.Path...))
+		readable := f.End - fileBegin
+		want := length - read
+		if readable > want {
+			readable = want
+		}
+		func() {
+			file, err := os.Open(name)
+			if err != nil {
+				return
+			}
+			defer file.Close()
+			file.ReadAt(block[read:read+readable], fileBegin-f.Begin)
+		}()
+		read += readable
+		fileBegin += readable
+		if read >= length {
+			break
+		}
+	}
+	return block, nil
+}
+
 // 处理下载响应，每次接收到响应直接将block写入到对应文件中
 func (pc *peerConn) handlePiece(buf []byte) {
 	piece := message.NewPiece()
@@ -365,6 +647,10 @@ func (pc *peerConn) handlePiece(buf []byte) {
 		}
 	}
 	pc.torrent.pieceStates.setBlockDone(int(piece.Index), int(piece.Begin))
+	pc.stats.addRead(blockLength, true)
+	pc.removePending(piece.Index, piece.Begin, uint32(blockLength))
+	// endgame模式下同一个block可能正从多个peer处下载，这里一到手就广播Cancel，减少重复传输的浪费
+	pc.torrent.picker.cancelDuplicateRequests(pc, piece.Index, piece.Begin, uint32(blockLength))
 	// 出队
 	<-pc.blockQueueCh
 
@@ -411,8 +697,11 @@ func (pc *peerConn) handlePiece(buf []byte) {
 		copy(downHash[:], sha1.Sum(nil))
 		if downHash == pc.torrent.MetaInfo.Info.Pieces[piece.Index] {
 			// piece下载完成
+			pc.torrent.pieceStates.markFinished(int(piece.Index))
 			pc.downloadedCh <- nil
 		} else {
+			// 校验失败，清空已收到的block让这个piece重新变回可下载状态
+			pc.torrent.pieceStates.resetPiece(int(piece.Index))
 			pc.downloadedCh <- errPieceCheckFailed
 		}
 		close(pc.downloadedCh)
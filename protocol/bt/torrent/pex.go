@@ -0,0 +1,194 @@
+package torrent
+
+import (
+	"encoding/binary"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+	"github.com/monkeyWie/gopeed/protocol/bt/peer"
+	"github.com/monkeyWie/gopeed/protocol/bt/peer/message"
+)
+
+// ut_pex (BEP 11) 在已建立的连接之间互相交换最近看到的其它peer地址
+const extUTPex = "ut_pex"
+
+// pexInterval 按BEP 11建议每分钟广播一次
+const pexInterval = 60 * time.Second
+
+// pexMaxAddrs 每条ut_pex消息最多携带的新增/丢弃地址数
+const pexMaxAddrs = 50
+
+func init() {
+	registerExtension(extUTPex, handleUTPex)
+}
+
+// pexState 记录上一轮发给该peer的地址集合，用于和这一轮diff出added/dropped
+type pexState struct {
+	lastSent map[string]bool
+}
+
+// runPEX 每pexInterval广播一次ut_pex，直到连接断开
+func (pc *peerConn) runPEX() {
+	pc.pex = &pexState{lastSent: make(map[string]bool)}
+	ticker := time.NewTicker(pexInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			pc.sendPEX()
+		case <-pc.disconnectCh:
+			return
+		}
+	}
+}
+
+// sendPEX 把当前种子已知的其它peer地址，和上一轮发给这个peer的集合diff出added/dropped，
+// 编码成ut_pex扩展消息发出去；IPv4和IPv6地址分别放进added/added6
+func (pc *peerConn) sendPEX() {
+	remoteID, ok := pc.peerExtensions[extUTPex]
+	if !ok {
+		return
+	}
+	current := make(map[string]*peer.Peer)
+	for _, p := range pc.torrent.knownPeerAddrs() {
+		current[p.Address()] = p
+	}
+
+	var added []*peer.Peer
+	for addr, p := range current {
+		if !pc.pex.lastSent[addr] {
+			added = append(added, p)
+		}
+	}
+	var dropped []string
+	for addr := range pc.pex.lastSent {
+		if _, ok := current[addr]; !ok {
+			dropped = append(dropped, addr)
+		}
+	}
+	if len(added) > pexMaxAddrs {
+		added = added[:pexMaxAddrs]
+	}
+	if len(dropped) > pexMaxAddrs {
+		dropped = dropped[:pexMaxAddrs]
+	}
+	if len(added) == 0 && len(dropped) == 0 {
+		return
+	}
+
+	addedV4, addedFlags, addedV6 := encodeCompactPeers(added)
+	droppedV4, droppedV6 := encodeCompactAddrs(dropped)
+
+	payload, _ := bencode.Marshal(map[string]interface{}{
+		"added":    string(addedV4),
+		"added.f":  string(addedFlags),
+		"added6":   string(addedV6),
+		"dropped":  string(droppedV4),
+		"dropped6": string(droppedV6),
+	})
+	pc.conn.Write(message.BuildExtended(byte(remoteID), payload))
+
+	// lastSent只记录这一轮真正塞进了消息里的地址：被pexMaxAddrs截断、没能发出去的
+	// 溢出地址必须继续留在下一轮的"尚未发送"集合里，否则它们会被当成已发送、永远不会
+	// 真正通过PEX到达这个peer
+	for _, p := range added {
+		pc.pex.lastSent[p.Address()] = true
+	}
+	for _, addr := range dropped {
+		delete(pc.pex.lastSent, addr)
+	}
+}
+
+// encodeCompactPeers 把peer地址按IPv4/IPv6拆成两组compact字节串，
+// IPv4额外附带一个全零的added.f标志字节(本实现暂不跟踪加密/seeder状态)
+func encodeCompactPeers(peers []*peer.Peer) (v4, flags, v6 []byte) {
+	for _, p := range peers {
+		portBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBuf, p.Port)
+		if ip4 := p.IP.To4(); ip4 != nil {
+			v4 = append(v4, ip4...)
+			v4 = append(v4, portBuf...)
+			flags = append(flags, 0)
+		} else {
+			v6 = append(v6, p.IP.To16()...)
+			v6 = append(v6, portBuf...)
+		}
+	}
+	return
+}
+
+// encodeCompactAddrs 同encodeCompactPeers，但输入是"host:port"字符串，用于dropped列表
+func encodeCompactAddrs(addrs []string) (v4, v6 []byte) {
+	for _, addr := range addrs {
+		host, portStr, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		port, err := strconv.ParseUint(portStr, 10, 16)
+		if err != nil {
+			continue
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+		portBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(portBuf, uint16(port))
+		if ip4 := ip.To4(); ip4 != nil {
+			v4 = append(v4, ip4...)
+			v4 = append(v4, portBuf...)
+		} else {
+			v6 = append(v6, ip.To16()...)
+			v6 = append(v6, portBuf...)
+		}
+	}
+	return
+}
+
+// handleUTPex 解码收到的ut_pex消息，把added/added6里的地址当作新发现的peer喂给peer池，
+// 来源标记为pex；dropped/dropped6暂不主动断开连接，留给将来的连接淘汰策略使用
+func handleUTPex(pc *peerConn, payload []byte) {
+	v, err := bencode.Unmarshal(payload)
+	if err != nil {
+		return
+	}
+	d, ok := v.(map[string]interface{})
+	if !ok {
+		return
+	}
+	var newPeers []*peer.Peer
+	if added, ok := d["added"].(string); ok {
+		newPeers = append(newPeers, decodeCompactPeersV4(added)...)
+	}
+	if added6, ok := d["added6"].(string); ok {
+		newPeers = append(newPeers, decodeCompactPeersV6(added6)...)
+	}
+	if len(newPeers) == 0 {
+		return
+	}
+	pc.torrent.addPeers(newPeers)
+}
+
+func decodeCompactPeersV4(addrs string) []*peer.Peer {
+	buf := []byte(addrs)
+	var peers []*peer.Peer
+	for i := 0; i+6 <= len(buf); i += 6 {
+		ip := net.IP(append([]byte{}, buf[i:i+4]...))
+		port := binary.BigEndian.Uint16(buf[i+4 : i+6])
+		peers = append(peers, peer.NewPeer(ip, port, peer.SourcePEX))
+	}
+	return peers
+}
+
+func decodeCompactPeersV6(addrs string) []*peer.Peer {
+	buf := []byte(addrs)
+	var peers []*peer.Peer
+	for i := 0; i+18 <= len(buf); i += 18 {
+		ip := net.IP(append([]byte{}, buf[i:i+16]...))
+		port := binary.BigEndian.Uint16(buf[i+16 : i+18])
+		peers = append(peers, peer.NewPeer(ip, port, peer.SourcePEX))
+	}
+	return peers
+}
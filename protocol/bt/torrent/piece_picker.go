@@ -0,0 +1,244 @@
+package torrent
+
+import (
+	"container/heap"
+	"sync"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/peer/message"
+)
+
+// MaxRequestsPerPiece 限制同一个piece最多同时从几个peer处请求，超过这个数就认为它已经"够忙"了，
+// 把机会让给其它还没人请求的piece
+const MaxRequestsPerPiece = 3
+
+// endgameThreshold 当未完成的piece数量降到这个阈值以下时进入endgame模式
+const endgameThreshold = 20
+
+// piecePicker 按稀有度（availability，即有多少个已连接的peer拥有这个piece）选piece，
+// 优先把请求发给全网最少见的piece，这样各个piece的完成时间更均匀、不容易在收尾阶段卡在
+// 某几个找不到源的piece上；当剩余piece不多时切换到endgame，允许同一个piece被多个peer重复请求
+type piecePicker struct {
+	mu        sync.Mutex
+	torrent   *Torrent
+	ps        *pieceStates
+	avail     []uint16            // 每个piece当前被多少个已连接peer拥有
+	priority  []PiecePriority     // 每个piece的下载优先级，由Reader按readahead窗口设置
+	assigned  map[int]int         // 每个piece当前被分配给了多少个peer在下载
+	owners    map[int][]*peerConn // 每个piece当前正在被哪些peerConn下载，供cancelBelowPriority精确取消
+	rarityIdx *rarityHeap         // 懒更新的、按(优先级, availability)排序的最小堆
+	endgame   bool
+}
+
+func newPiecePicker(t *Torrent, ps *pieceStates) *piecePicker {
+	size := ps.size()
+	p := &piecePicker{
+		torrent:  t,
+		ps:       ps,
+		avail:    make([]uint16, size),
+		priority: make([]PiecePriority, size),
+		assigned: make(map[int]int),
+		owners:   make(map[int][]*peerConn),
+	}
+	h := make(rarityHeap, size)
+	for i := range h {
+		h[i] = &rarityEntry{index: i}
+	}
+	heap.Init(&h)
+	p.rarityIdx = &h
+	return p
+}
+
+// setPriority 调整一个piece的下载优先级，供Reader按readahead窗口驱动
+func (p *piecePicker) setPriority(index int, priority PiecePriority) {
+	p.mu.Lock()
+	p.priority[index] = priority
+	p.mu.Unlock()
+}
+
+// cancelBelowPriority 取消[keepFirst,keepLast]范围之外、优先级低于minPriority的piece上
+// 尚未完成的下载请求，用于Reader的responsive模式尽快腾出带宽。实际的Cancel由每个
+// 连接自己的cancelPiece发出，精确匹配它已经发出的(begin,length)，而不是瞎猜一个固定值
+func (p *piecePicker) cancelBelowPriority(keepFirst, keepLast int, minPriority PiecePriority) {
+	p.mu.Lock()
+	owners := make(map[int][]*peerConn)
+	for i, pr := range p.priority {
+		if (i < keepFirst || i > keepLast) && pr < minPriority && p.assigned[i] > 0 {
+			owners[i] = append([]*peerConn(nil), p.owners[i]...)
+		}
+	}
+	p.mu.Unlock()
+	for index, pcs := range owners {
+		for _, pc := range pcs {
+			pc.cancelPiece(index)
+		}
+	}
+}
+
+// onBitfield 在收到一个peer的完整bitfield时，把它拥有的每个piece的availability加一
+func (p *piecePicker) onBitfield(bitfield *message.Bitfield) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.avail {
+		if bitfield.Has(i) {
+			p.avail[i]++
+		}
+	}
+	p.checkEndgame()
+}
+
+// onHave 在收到单个Have通知，或者peer断开（have=false）时增量调整该piece的availability
+func (p *piecePicker) onHave(index int, have bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if have {
+		p.avail[index]++
+	} else if p.avail[index] > 0 {
+		p.avail[index]--
+	}
+}
+
+// onDisconnect 一个peer断开时，把它bitfield里拥有的piece的availability都减一
+func (p *piecePicker) onDisconnect(bitfield *message.Bitfield) {
+	if bitfield == nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i := range p.avail {
+		if bitfield.Has(i) && p.avail[i] > 0 {
+			p.avail[i]--
+		}
+	}
+}
+
+func (p *piecePicker) checkEndgame() {
+	if p.endgame {
+		return
+	}
+	remaining := 0
+	for i := 0; i < p.ps.size(); i++ {
+		if p.ps.getState(i) != stateFinish {
+			remaining++
+		}
+	}
+	if remaining > 0 && remaining < endgameThreshold {
+		p.endgame = true
+	}
+}
+
+// PickPiece 为pc挑一个piece来下载：endgame模式下任何它拥有的未完成piece都可以选
+// （允许和其它peer的请求重复，靠Cancel收尾）；正常模式下只挑"这个peer有、我们还没有、
+// 且还没被MaxRequestsPerPiece个peer占用"的piece里优先级最高、同优先级内全网最稀有的一个
+func (p *piecePicker) PickPiece(pc *peerConn, bitfield *message.Bitfield, inFlight map[int]bool) (int, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.checkEndgame()
+
+	if p.endgame {
+		for i := 0; i < p.ps.size(); i++ {
+			if p.ps.getState(i) != stateFinish && bitfield.Has(i) {
+				p.owners[i] = append(p.owners[i], pc)
+				return i, true
+			}
+		}
+		return 0, false
+	}
+
+	var skipped []*rarityEntry
+	defer func() {
+		for _, e := range skipped {
+			heap.Push(p.rarityIdx, e)
+		}
+	}()
+	for p.rarityIdx.Len() > 0 {
+		entry := heap.Pop(p.rarityIdx).(*rarityEntry)
+		index := entry.index
+		if p.ps.getState(index) == stateFinish {
+			// 已完成的piece不会再变回未完成，直接从堆里丢弃而不再入堆，
+			// 否则收尾阶段堆里会积满已完成的piece，重新退化成每次都要扫一遍
+			continue
+		}
+		if entry.stale(p.avail[index], p.priority[index]) {
+			// availability或priority已经变了，按最新值重新入堆再继续弹
+			entry.count = p.avail[index]
+			entry.priority = p.priority[index]
+			heap.Push(p.rarityIdx, entry)
+			continue
+		}
+		if !bitfield.Has(index) || p.assigned[index] >= MaxRequestsPerPiece || inFlight[index] {
+			skipped = append(skipped, entry)
+			continue
+		}
+		p.assigned[index]++
+		p.owners[index] = append(p.owners[index], pc)
+		skipped = append(skipped, entry)
+		return index, true
+	}
+	return 0, false
+}
+
+// cancelDuplicateRequests 在endgame模式下，一个block从某个peer处到手后，
+// 向其它所有还连着的peer广播Cancel，避免继续传输同一个block造成的带宽浪费
+func (p *piecePicker) cancelDuplicateRequests(from *peerConn, index, begin, length uint32) {
+	p.mu.Lock()
+	endgame := p.endgame
+	p.mu.Unlock()
+	if !endgame {
+		return
+	}
+	cancel := message.BuildCancel(index, begin, length).EncodeCancel()
+	for _, other := range from.torrent.peerConns() {
+		if other == from {
+			continue
+		}
+		other.conn.Write(cancel)
+	}
+}
+
+// ReleasePiece 在一次下载结束（成功、失败、被取消或连接断开）后释放pc对某个piece的占用
+func (p *piecePicker) ReleasePiece(index int, pc *peerConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.assigned[index] > 0 {
+		p.assigned[index]--
+	}
+	owners := p.owners[index]
+	for i, o := range owners {
+		if o == pc {
+			p.owners[index] = append(owners[:i], owners[i+1:]...)
+			break
+		}
+	}
+}
+
+// rarityEntry 是堆里的一个piece条目，count/priority是它入堆时的availability和优先级快照
+type rarityEntry struct {
+	index    int
+	count    uint16
+	priority PiecePriority
+}
+
+func (e *rarityEntry) stale(currentCount uint16, currentPriority PiecePriority) bool {
+	return e.count != currentCount || e.priority != currentPriority
+}
+
+// rarityHeap 是按(priority降序, count升序)排序的最小堆：同一优先级带内按rarest-first排，
+// 不同优先级之间高优先级（比如Reader标记的PiecePriorityNow）总是排在前面
+type rarityHeap []*rarityEntry
+
+func (h rarityHeap) Len() int { return len(h) }
+func (h rarityHeap) Less(i, j int) bool {
+	if h[i].priority != h[j].priority {
+		return h[i].priority > h[j].priority
+	}
+	return h[i].count < h[j].count
+}
+func (h rarityHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *rarityHeap) Push(x interface{}) { *h = append(*h, x.(*rarityEntry)) }
+func (h *rarityHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,98 @@
+package torrent
+
+import (
+	"sync"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/metainfo"
+)
+
+// pieceState 是单个piece的下载状态
+type pieceState int
+
+const (
+	stateMissing pieceState = iota
+	stateDownloading
+	stateFinish
+)
+
+// pieceInfo 按block粒度记录一个piece的完成情况，blocksDone[i]为true表示第i个block已经收到
+type pieceInfo struct {
+	state      pieceState
+	blockCount int
+	blocksDone []bool
+}
+
+// pieceStates 是整个种子所有piece的状态表：downloadPiece/handlePiece按block粒度更新，
+// piece picker和Reader按piece粒度查询，读写都要经过mu，因为多个peerConn goroutine会并发访问
+type pieceStates struct {
+	mu     sync.Mutex
+	states []pieceInfo
+}
+
+// newPieceStates 按MetaInfo里的piece长度切出每个piece应有的block数，MetaInfo.Info
+// 必须已经就绪（.torrent文件直接有，magnet链接要等metadata.go抓完才会调用）
+func newPieceStates(metaInfo *metainfo.MetaInfo) *pieceStates {
+	count := len(metaInfo.Info.Pieces)
+	states := make([]pieceInfo, count)
+	for i := range states {
+		blockCount := (metaInfo.GetPieceLength(i) + blockSize - 1) / blockSize
+		states[i] = pieceInfo{blockCount: blockCount, blocksDone: make([]bool, blockCount)}
+	}
+	return &pieceStates{states: states}
+}
+
+func (ps *pieceStates) size() int {
+	return len(ps.states)
+}
+
+func (ps *pieceStates) getState(index int) pieceState {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.states[index].state
+}
+
+// isBlockDone 判断begin对应的block是否已经收到过
+func (ps *pieceStates) isBlockDone(index, begin int) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.states[index].blocksDone[begin/blockSize]
+}
+
+// setBlockDone 记录一个block已经收到。piece真正的stateFinish要等SHA-1校验通过后
+// 由markFinished设置，这里只是把状态推进到"正在下载"，避免和从未开始下载的piece混淆
+func (ps *pieceStates) setBlockDone(index, begin int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.states[index].blocksDone[begin/blockSize] = true
+	ps.states[index].state = stateDownloading
+}
+
+// isPieceDone 判断一个piece的所有block是否都已经收到（尚不代表SHA-1校验通过）
+func (ps *pieceStates) isPieceDone(index int) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for _, done := range ps.states[index].blocksDone {
+		if !done {
+			return false
+		}
+	}
+	return true
+}
+
+// markFinished 在SHA-1校验通过后把piece标记为最终完成态，picker和Reader据此判断一个
+// piece是否真正可用——已完成的piece不会再变回未完成，见piece_picker.go的堆清理逻辑
+func (ps *pieceStates) markFinished(index int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	ps.states[index].state = stateFinish
+}
+
+// resetPiece 在SHA-1校验失败后清空该piece已收到的block，让它重新变回可下载状态
+func (ps *pieceStates) resetPiece(index int) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	for i := range ps.states[index].blocksDone {
+		ps.states[index].blocksDone[i] = false
+	}
+	ps.states[index].state = stateMissing
+}
@@ -0,0 +1,68 @@
+package torrent
+
+import (
+	"testing"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/bencode"
+	"github.com/monkeyWie/gopeed/protocol/bt/metainfo"
+)
+
+// testMetaInfo构造一个2个piece、每个piece正好两个block大小的最小info字典，
+// 使用只含一个文件的multi-file格式
+func testMetaInfo(t *testing.T) *metainfo.MetaInfo {
+	raw, err := bencode.Marshal(map[string]interface{}{
+		"piece length": int64(2 * blockSize),
+		"pieces":       string(make([]byte, 40)),
+		"files": []interface{}{
+			map[string]interface{}{
+				"length": int64(4 * blockSize),
+				"path":   []interface{}{"a.bin"},
+			},
+		},
+	})
+	if err != nil {
+		t.Fatalf("marshal test info: %v", err)
+	}
+	info, err := metainfo.ParseInfo(raw)
+	if err != nil {
+		t.Fatalf("parse test info: %v", err)
+	}
+	return &metainfo.MetaInfo{Info: info}
+}
+
+func TestPieceStatesBlockAndPieceCompletion(t *testing.T) {
+	ps := newPieceStates(testMetaInfo(t))
+
+	if ps.size() != 2 {
+		t.Fatalf("expected 2 pieces, got %d", ps.size())
+	}
+	if ps.isPieceDone(0) {
+		t.Fatalf("piece 0 should not be done yet")
+	}
+
+	ps.setBlockDone(0, 0)
+	if ps.getState(0) != stateDownloading {
+		t.Fatalf("expected stateDownloading after first block, got %v", ps.getState(0))
+	}
+	if !ps.isBlockDone(0, 0) {
+		t.Fatalf("expected block at offset 0 to be marked done")
+	}
+	if ps.isPieceDone(0) {
+		t.Fatalf("piece with only one of two blocks should not be done")
+	}
+
+	ps.setBlockDone(0, blockSize)
+	if !ps.isPieceDone(0) {
+		t.Fatalf("expected piece 0 to be done once all blocks arrived")
+	}
+
+	ps.markFinished(0)
+	if ps.getState(0) != stateFinish {
+		t.Fatalf("expected stateFinish after markFinished, got %v", ps.getState(0))
+	}
+
+	ps.resetPiece(0)
+	if ps.getState(0) != stateMissing || ps.isPieceDone(0) {
+		t.Fatalf("expected resetPiece to clear blocks and state back to stateMissing")
+	}
+}
@@ -0,0 +1,213 @@
+package torrent
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// PiecePriority 控制piece picker挑片时的优先级，数值越大越优先
+type PiecePriority int
+
+const (
+	PiecePriorityNormal PiecePriority = iota
+	PiecePriorityReadahead
+	PiecePriorityNow
+)
+
+// defaultReadahead 默认预读字节数，约4MiB，覆盖大多数视频容器的一个GOP
+const defaultReadahead = 4 * 1024 * 1024
+
+var errReaderClosed = errors.New("torrent: reader closed")
+
+// Reader 让调用方可以像读本地文件一样，从一个尚未下载完成的种子文件里流式读取数据：
+// Read/ReadAt在底层piece还没下载并校验完成时会阻塞，同时把即将用到的piece标记为高优先级，
+// 这样piece picker会优先把这些piece下载下来，而不是严格按rarest-first的顺序
+type Reader struct {
+	torrent    *Torrent
+	fileIndex  int
+	fileBegin  int64
+	fileEnd    int64
+	pos        int64
+	readahead  int64
+	responsive bool
+
+	mu     sync.Mutex
+	closed bool
+}
+
+// NewReader 返回一个指定文件的流式Reader，fileIndex对应MetaInfo.Info.Files的下标
+// （单文件种子传0）
+func (t *Torrent) NewReader(fileIndex int) *Reader {
+	fds := t.MetaInfo.GetFileDetails()
+	var begin, end int64
+	if len(fds) == 0 {
+		end = t.MetaInfo.Info.Length
+	} else {
+		begin = fds[fileIndex].Begin
+		end = fds[fileIndex].End
+	}
+	return &Reader{
+		torrent:   t,
+		fileIndex: fileIndex,
+		fileBegin: begin,
+		fileEnd:   end,
+		readahead: defaultReadahead,
+	}
+}
+
+// SetReadahead 调整预读窗口大小，单位字节
+func (r *Reader) SetReadahead(n int64) {
+	r.mu.Lock()
+	r.readahead = n
+	r.mu.Unlock()
+}
+
+// SetResponsive 开启"响应式"模式：一次连续的顺序读取会取消为更低优先级piece发出的请求，
+// 从而让当前读取位置尽快就绪，用于交互式拖动播放进度这类场景
+func (r *Reader) SetResponsive(responsive bool) {
+	r.mu.Lock()
+	r.responsive = responsive
+	r.mu.Unlock()
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.mu.Lock()
+	pos := r.pos
+	r.mu.Unlock()
+
+	n, err := r.ReadAt(p, pos)
+	if err == nil {
+		r.mu.Lock()
+		r.pos = pos + int64(n)
+		r.mu.Unlock()
+	}
+	return n, err
+}
+
+// ReadAt 满足io.ReaderAt的约定：并发安全，且绝不修改Read/Seek依赖的r.pos
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return 0, errReaderClosed
+	}
+	readahead := r.readahead
+	responsive := r.responsive
+	r.mu.Unlock()
+
+	if off >= r.fileEnd-r.fileBegin {
+		return 0, io.EOF
+	}
+	absBegin := r.fileBegin + off
+	absEnd := absBegin + int64(len(p))
+	if absEnd > r.fileEnd {
+		absEnd = r.fileEnd
+	}
+
+	r.applyPriorities(absBegin, absEnd, readahead, responsive)
+
+	if err := r.waitRange(absBegin, absEnd); err != nil {
+		return 0, err
+	}
+
+	return r.readFile(p[:absEnd-absBegin], absBegin)
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var newPos int64
+	switch whence {
+	case io.SeekStart:
+		newPos = offset
+	case io.SeekCurrent:
+		newPos = r.pos + offset
+	case io.SeekEnd:
+		newPos = (r.fileEnd - r.fileBegin) + offset
+	default:
+		return 0, errors.New("torrent: invalid whence")
+	}
+	if newPos < 0 {
+		return 0, errors.New("torrent: negative position")
+	}
+	r.pos = newPos
+	return newPos, nil
+}
+
+func (r *Reader) Close() error {
+	r.mu.Lock()
+	r.closed = true
+	r.mu.Unlock()
+	return nil
+}
+
+// applyPriorities 把[begin,end)所在的piece标记为PiecePriorityNow，紧随其后readahead字节
+// 范围内的piece标记为PiecePriorityReadahead，其它piece退回PiecePriorityNormal；
+// responsive模式下还会取消为低优先级piece发出、尚未完成的请求，让当前位置更快就绪
+func (r *Reader) applyPriorities(begin, end, readahead int64, responsive bool) {
+	pieceLength := r.torrent.MetaInfo.Info.PieceLength
+	nowFirst := int(begin / pieceLength)
+	nowLast := int((end - 1) / pieceLength)
+	readaheadPieces := int((readahead + pieceLength - 1) / pieceLength)
+	readaheadLast := nowLast + readaheadPieces
+
+	picker := r.torrent.picker
+	total := picker.ps.size()
+	for i := 0; i < total; i++ {
+		switch {
+		case i >= nowFirst && i <= nowLast:
+			picker.setPriority(i, PiecePriorityNow)
+		case i > nowLast && i <= readaheadLast:
+			picker.setPriority(i, PiecePriorityReadahead)
+		default:
+			picker.setPriority(i, PiecePriorityNormal)
+		}
+	}
+	if responsive {
+		picker.cancelBelowPriority(nowFirst, nowLast, PiecePriorityNow)
+	}
+}
+
+// waitRange 阻塞直到[begin,end)覆盖的所有piece都下载并校验完成
+func (r *Reader) waitRange(begin, end int64) error {
+	pieceLength := r.torrent.MetaInfo.Info.PieceLength
+	first := int(begin / pieceLength)
+	last := int((end - 1) / pieceLength)
+	for i := first; i <= last; i++ {
+		for r.torrent.pieceStates.getState(i) != stateFinish {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return errReaderClosed
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+	return nil
+}
+
+// readFile 直接从磁盘读取已经校验完成的数据，文件路径映射规则与handlePiece写入时一致
+func (r *Reader) readFile(p []byte, absOffset int64) (int, error) {
+	info := r.torrent.MetaInfo.Info
+	fds := r.torrent.MetaInfo.GetFileDetails()
+	if len(fds) == 0 {
+		file, err := os.Open(filepath.Join(r.torrent.Path, info.Name))
+		if err != nil {
+			return 0, err
+		}
+		defer file.Close()
+		return file.ReadAt(p, absOffset)
+	}
+	writeIndex := getWriteFile(absOffset, fds)
+	file, err := os.Open(filepath.Join(r.torrent.Path, filepath.Join(fds[writeIndex].Path...)))
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	return file.ReadAt(p, absOffset-fds[writeIndex].Begin)
+}
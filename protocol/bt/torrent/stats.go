@@ -0,0 +1,192 @@
+package torrent
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/peer"
+)
+
+// ewmaWindow 统计下载/上传速率用的指数加权窗口，和大多数BT客户端保持一致
+const ewmaWindow = 20 * time.Second
+
+// MaxConnections 是单个种子允许同时保持的peer连接数上限，超过时由连接reaper负责清理
+const MaxConnections = 200
+
+// reapInterval 每隔这么久检查一次是否需要淘汰连接
+const reapInterval = 30 * time.Second
+
+// reapCount 每次淘汰的连接数
+const reapCount = 5
+
+// ConnStats 记录单个peerConn的字节/chunk计数。handlePiece把每个收到的block都按useful计入，
+// 包括所在piece之后SHA-1校验失败的block；WastedBytes只由addRead(n, false)累加，而本包中没有这样的调用
+type ConnStats struct {
+	mu              sync.Mutex
+	BytesRead       int64
+	BytesWritten    int64
+	ChunksRead      int64
+	ChunksWritten   int64
+	UsefulBytes     int64
+	WastedBytes     int64
+	LastUsefulChunk time.Time
+
+	downloadEWMA ewmaRate
+	uploadEWMA   ewmaRate
+}
+
+// addRead 记录一次收到的block，useful=false用于piece校验失败等被丢弃的数据
+func (s *ConnStats) addRead(n int64, useful bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.BytesRead += n
+	s.ChunksRead++
+	if useful {
+		s.UsefulBytes += n
+		s.LastUsefulChunk = time.Now()
+	} else {
+		s.WastedBytes += n
+	}
+	s.downloadEWMA.update(n)
+}
+
+// addWritten 记录一次上传出去的block
+func (s *ConnStats) addWritten(n int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.BytesWritten += n
+	s.ChunksWritten++
+	s.uploadEWMA.update(n)
+}
+
+func (s *ConnStats) downloadRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.downloadEWMA.rate()
+}
+
+func (s *ConnStats) uploadRate() float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.uploadEWMA.rate()
+}
+
+// snapshot 在锁内一次性取出Stats()需要的计数字段，避免和addRead/addWritten的并发写竞争
+func (s *ConnStats) snapshot() (usefulBytes, bytesWritten, wastedBytes int64, lastUsefulChunk time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.UsefulBytes, s.BytesWritten, s.WastedBytes, s.LastUsefulChunk
+}
+
+// ewmaRate 是一个指数加权移动平均速率计数器：每次update按elapsed/ewmaWindow（最大为1）的权重
+// 混入这次的瞬时速率，距上次采样超过ewmaWindow时旧值被完全替换
+type ewmaRate struct {
+	bytesPerSec float64
+	lastSample  time.Time
+}
+
+func (e *ewmaRate) update(n int64) {
+	now := time.Now()
+	if e.lastSample.IsZero() {
+		e.lastSample = now
+		e.bytesPerSec = float64(n) / ewmaWindow.Seconds()
+		return
+	}
+	elapsed := now.Sub(e.lastSample).Seconds()
+	e.lastSample = now
+	if elapsed <= 0 {
+		return
+	}
+	instant := float64(n) / elapsed
+	weight := elapsed / ewmaWindow.Seconds()
+	if weight > 1 {
+		weight = 1
+	}
+	e.bytesPerSec = e.bytesPerSec*(1-weight) + instant*weight
+}
+
+func (e *ewmaRate) rate() float64 {
+	return e.bytesPerSec
+}
+
+// PeerStat 是Stats()返回的单个peer快照
+type PeerStat struct {
+	Address         string
+	Source          peer.Source
+	DownloadRate    float64
+	UploadRate      float64
+	UsefulBytes     int64
+	WastedBytes     int64
+	LastUsefulChunk time.Time
+}
+
+// TorrentStats 是一个种子当前的整体统计快照
+type TorrentStats struct {
+	TotalDownloaded int64
+	TotalUploaded   int64
+	DownloadRate    float64
+	UploadRate      float64
+	BySource        map[peer.Source]int
+	Peers           []PeerStat
+}
+
+// Stats 汇总当前所有已连接peerConn的ConnStats，给调用方展示下载进度、速率和来源分布
+func (t *Torrent) Stats() *TorrentStats {
+	conns := t.peerConns()
+	stats := &TorrentStats{
+		BySource: make(map[peer.Source]int),
+		Peers:    make([]PeerStat, 0, len(conns)),
+	}
+	for _, pc := range conns {
+		useful, written, wasted, lastUseful := pc.stats.snapshot()
+		stats.TotalDownloaded += useful
+		stats.TotalUploaded += written
+		stats.DownloadRate += pc.stats.downloadRate()
+		stats.UploadRate += pc.stats.uploadRate()
+		stats.BySource[pc.peer.Source]++
+		stats.Peers = append(stats.Peers, PeerStat{
+			Address:         pc.peer.Address(),
+			Source:          pc.peer.Source,
+			DownloadRate:    pc.stats.downloadRate(),
+			UploadRate:      pc.stats.uploadRate(),
+			UsefulBytes:     useful,
+			WastedBytes:     wasted,
+			LastUsefulChunk: lastUseful,
+		})
+	}
+	return stats
+}
+
+// runConnReaper 每隔reapInterval检查一次连接数，超过MaxConnections时按下载速率从慢到快
+// 淘汰reapCount个连接——这避免了那些通过了2分钟keepalive检测、但实际上从不发block的
+// "僵尸连接"一直占着peer slot
+func (t *Torrent) runConnReaper(stopCh <-chan struct{}) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.reapWorstConns()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (t *Torrent) reapWorstConns() {
+	conns := t.peerConns()
+	if len(conns) <= MaxConnections {
+		return
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].stats.downloadRate() < conns[j].stats.downloadRate()
+	})
+	n := reapCount
+	if n > len(conns) {
+		n = len(conns)
+	}
+	for _, pc := range conns[:n] {
+		pc.conn.Close()
+	}
+}
@@ -0,0 +1,135 @@
+package torrent
+
+import (
+	"sync"
+
+	"github.com/monkeyWie/gopeed/protocol/bt/dht"
+	"github.com/monkeyWie/gopeed/protocol/bt/metainfo"
+	"github.com/monkeyWie/gopeed/protocol/bt/peer"
+	log "github.com/sirupsen/logrus"
+)
+
+// Torrent 代表一次BT下载/做种任务：持有种子元信息、piece完成状态、piece picker，
+// 以及当前所有已建立的peer连接。choke控制器、DHT查找、连接reaper等后台协程都通过它
+// 互相访问对方维护的状态，生命周期由Start/Stop管理（见lifecycle.go）
+type Torrent struct {
+	MetaInfo *metainfo.MetaInfo
+	Path     string
+	PeerID   [20]byte
+
+	pieceStates *pieceStates
+	picker      *piecePicker
+	metadata    *metadataFetcher
+	dht         *dht.DHT
+	chokeCtrl   *chokeController
+
+	connReaperStop chan struct{}
+
+	connsMu sync.Mutex
+	// conns以地址为key，value在拨号/握手完成前是nil占位，防止同一地址被并发重复拨号
+	conns map[string]*peerConn
+}
+
+// NewTorrent 根据已经解析好的.torrent元信息创建一个下载任务，Path是保存数据的目录，
+// peerID是本地客户端的BT peer id
+func NewTorrent(metaInfo *metainfo.MetaInfo, path string, peerID [20]byte) *Torrent {
+	t := &Torrent{
+		MetaInfo: metaInfo,
+		Path:     path,
+		PeerID:   peerID,
+		conns:    make(map[string]*peerConn),
+	}
+	t.initPieceStates()
+	return t
+}
+
+// NewMagnetTorrent 根据解析好的磁力链接创建一个下载任务：这时还没有info字典，
+// MetaInfo.Info保持nil，要等metadata.go通过ut_metadata抓到完整info并调用
+// initPieceStates后，种子才真正进入可下载状态
+func NewMagnetTorrent(m *Magnet, path string, peerID [20]byte) *Torrent {
+	return &Torrent{
+		MetaInfo: metainfo.NewMagnetMetaInfo(m.InfoHash),
+		Path:     path,
+		PeerID:   peerID,
+		conns:    make(map[string]*peerConn),
+	}
+}
+
+// initPieceStates 在info字典就绪后（直接来自.torrent文件，或者ut_metadata抓取完成，
+// 见metadata.go:onMetadataComplete）初始化piece状态表和piece picker
+func (t *Torrent) initPieceStates() {
+	t.pieceStates = newPieceStates(t.MetaInfo)
+	t.picker = newPiecePicker(t, t.pieceStates)
+}
+
+// peerConns 返回当前所有已建立（拨号和握手都已完成）的peer连接快照，
+// 供choke控制器、Stats()和endgame的Cancel广播使用
+func (t *Torrent) peerConns() []*peerConn {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	conns := make([]*peerConn, 0, len(t.conns))
+	for _, pc := range t.conns {
+		if pc != nil {
+			conns = append(conns, pc)
+		}
+	}
+	return conns
+}
+
+// knownPeerAddrs 返回当前已连接的peer地址，供ut_pex广播给对方（见pex.go）
+func (t *Torrent) knownPeerAddrs() []*peer.Peer {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	addrs := make([]*peer.Peer, 0, len(t.conns))
+	for _, pc := range t.conns {
+		if pc != nil {
+			addrs = append(addrs, pc.peer)
+		}
+	}
+	return addrs
+}
+
+// addPeers 把DHT/PEX新发现的peer地址接入连接池：已经连接或正在拨号中的地址会被跳过，
+// 其余的各自起一个goroutine拨号、握手并开始下载（见connectPeer）
+func (t *Torrent) addPeers(peers []*peer.Peer) {
+	for _, p := range peers {
+		addr := p.Address()
+		t.connsMu.Lock()
+		_, exists := t.conns[addr]
+		if !exists {
+			t.conns[addr] = nil
+		}
+		t.connsMu.Unlock()
+		if exists {
+			continue
+		}
+		go t.connectPeer(addr, p)
+	}
+}
+
+// connectPeer 拨号、握手成功后把连接注册进连接池并驱动它持续下载，直到连接断开，
+// 结束后把自己从连接池里移除，空出地址让之后的addPeers可以重新尝试
+func (t *Torrent) connectPeer(addr string, p *peer.Peer) {
+	pc := newPeerConn(t, p)
+	if err := pc.ready(); err != nil {
+		log.Debugf("connect %s failed: %v", addr, err)
+		t.removeConn(addr)
+		return
+	}
+	t.connsMu.Lock()
+	t.conns[addr] = pc
+	t.connsMu.Unlock()
+
+	pc.runDownload()
+
+	if t.picker != nil {
+		t.picker.onDisconnect(pc.bitfield)
+	}
+	t.removeConn(addr)
+}
+
+func (t *Torrent) removeConn(addr string) {
+	t.connsMu.Lock()
+	delete(t.conns, addr)
+	t.connsMu.Unlock()
+}